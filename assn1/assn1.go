@@ -4,6 +4,9 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/fenilfadadu/cs628-assn1/userlib"
 )
@@ -12,51 +15,323 @@ type Privatekey = userlib.PrivateKey
 
 var BlockSize = userlib.BlockSize
 
-type User_r struct {
-	KeyAddr   string
-	Signature []byte
-	User
-}
-
 type User struct {
 	Username string
 	Password string
 	Privkey  *Privatekey
+
+	// Symmetric key protecting the user's Inodes
+	RootKey []byte
+
+	// Where the index of the user's filenames is and the key sealing
+	// it, see ListFiles
+	IndexAddr string
+	IndexKey  []byte
+
+	// The newest version of each file this session has seen, by the
+	// FileID of its SharingRecord, so that a file deleted and created
+	// again under the same name starts afresh.  It survives in Session,
+	// not in the stored User.
+	Seen map[string]FileVersion
+
+	// The untrusted storage this session is bound to (never stored)
+	backend Backend
+}
+
+// FileVersion identifies one version of a file's SharingRecord
+type FileVersion struct {
+	Version uint64
+	Hash    []byte
+}
+
+// Backend bundles the storage a User session talks to: the untrusted
+// Datastore and the public key directory.  Sessions created through
+// different Backends are fully isolated.
+type Backend struct {
+	Datastore userlib.Datastore
+	Keystore  userlib.Keystore
+
+	// Files are written in data blocks of at most ChunkSize bytes; 0
+	// means DefaultChunkSize.  A stored block takes about 4/3 of its
+	// size plus a few hundred bytes.
+	ChunkSize int
+
+	// Appends compact a file (see Compact) each time its block list
+	// grows past another multiple of CompactAfter; 0 means
+	// DefaultCompactAfter and a negative value never compacts.  The
+	// SharingRecord lists every block in about 150 bytes, so a store
+	// that refuses large values (like kvfs-server's -max-value, 4 MiB
+	// by default) refuses appends to a file of some 25000 blocks
+	// unless small appends are compacted.
+	CompactAfter int
+}
+
+// The chunk size of a Backend that doesn't set one
+const DefaultChunkSize = 1 << 20
+
+// The CompactAfter of a Backend that doesn't set one, which keeps the
+// SharingRecord of a file written in small appends around 150 KB
+const DefaultCompactAfter = 1000
+
+// DefaultBackend is the package-level storage provided by userlib.
+// InitUser and GetUser bind their sessions to it.
+var DefaultBackend = Backend{
+	Datastore: userlib.DefaultDatastore,
+	Keystore:  userlib.DefaultKeystore,
+}
+
+// Unset fields of a Backend fall back to the package-level stores
+func (backend Backend) datastore() userlib.Datastore {
+	if backend.Datastore == nil {
+		return userlib.DefaultDatastore
+	}
+	return backend.Datastore
+}
+
+func (backend Backend) chunkSize() int {
+	if backend.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return backend.ChunkSize
+}
+
+// How many blocks appends add between compactions, 0 for never
+func (backend Backend) compactAfter() int {
+	switch {
+	case backend.CompactAfter == 0:
+		return DefaultCompactAfter
+	case backend.CompactAfter < 0:
+		return 0
+	}
+	return backend.CompactAfter
+}
+
+func (backend Backend) keystore() userlib.Keystore {
+	if backend.Keystore == nil {
+		return userlib.DefaultKeystore
+	}
+	return backend.Keystore
+}
+
+// Returns the datastore this session is bound to
+func (user *User) datastore() userlib.Datastore {
+	return user.backend.datastore()
 }
 
-type Inode_r struct {
-	KeyAddr   string
-	Signature []byte
-	Inode
+// Returns the keystore this session is bound to
+func (user *User) keystore() userlib.Keystore {
+	return user.backend.keystore()
 }
 
 type Inode struct {
 	Filename     string
+	Owner        string
 	ShRecordAddr string
 	SymmKey      []byte
+
+	// The file's write capability, nil for read-only shares
+	WriteKey userlib.SignKey
+
+	// Files shared with us reach the SharingRecord through an access
+	// node instead, so the owner can move the record without us
+	AccessAddr string
+	AccessKey  []byte
+
+	// Who received the share.  The share was granted to them, not to
+	// the directory it may be linked into, so there AccessKey is kept
+	// in Received, sealed under a key of theirs (see receivedSecret).
+	Receiver string
+	Received []byte
+
+	// Set for directories, whose SharingRecord holds a directory
+	Dir bool
+
+	// Inside a directory, whoever can read the directory can read the
+	// Inode, so WriteKey is kept in Sealed instead, see writeSecrets
+	Sealed []byte
+
+	// The key the Inode is sealed under: the user's root key for a
+	// top-level name, or the one in its directory entry, and the
+	// directory it was found in (never stored)
+	key    []byte
+	parent *Inode
 }
 
-type SharingRecord_r struct {
-	KeyAddr   string
-	Signature []byte
-	SharingRecord
+// Mode is the access ShareFileWithMode grants
+type Mode int
+
+const (
+	// Read, append, overwrite and share further
+	ReadWrite Mode = iota
+
+	// Only read: the recipient doesn't get the write capability, so
+	// whatever they write is rejected by every collaborator
+	ReadOnly
+)
+
+func (mode Mode) String() string {
+	if mode == ReadOnly {
+		return "read-only"
+	}
+	return "read-write"
 }
 
+// The Type of a SharingRecord
+const (
+	fileRecord = "Sharing Record"
+	dirRecord  = "Directory"
+)
+
 type SharingRecord struct {
 	Type       string
 	MainAuthor string
+	OwnerSig   []byte // MainAuthor's signature over ownershipClaim
 	Address    []string
 	SymmKey    [][]byte
+	Hashes     [][]byte // SHA256 of every sealed block
+	Lengths    []int    // length of every block's value
+
+	// Random, chosen when the file is created and kept when a
+	// revocation moves the record.  Covered by the owner's signature
+	// and by the signature on every block.
+	FileID string
+
+	// The sharing tree, in the order the shares were made
+	Grants []Grant
+
+	// Every write bumps Version and chains to the hash of the version
+	// it replaced, so that sessions can detect rollbacks and forks
+	Version  uint64
+	PrevHash []byte
+
+	// Only holders of the write capability can produce WriteSig, the
+	// signature over the record (see writeClaim).  WritePub is covered
+	// by the owner's signature.
+	WritePub userlib.VerifyKey
+	WriteSig []byte
+
+	// Hash of the write claim as loaded (never stored)
+	hash []byte
+}
+
+// Grant records one ShareFile call.  The grantee reaches the file
+// through the access node at AccessAddr, whose key is RSA encrypted to
+// the owner so that the owner (and nobody else) can re-point it after
+// a revocation.
+type Grant struct {
+	Grantor    string
+	Grantee    string
+	AccessAddr string
+	WrappedKey []byte
+	Mode       Mode
+	Time       time.Time
+	Signature  []byte // Grantor's signature over grantClaim
+}
+
+// What the grantor of a Grant signs
+type grantClaim struct {
+	Grantor    string
+	Grantee    string
+	AccessAddr string
+	WrappedKey []byte
+	Mode       Mode
+	Time       time.Time
+}
+
+// Returns what the grantor signs for this grant
+func (grant *Grant) claim() ([]byte, error) {
+	return json.Marshal(grantClaim{
+		Grantor:    grant.Grantor,
+		Grantee:    grant.Grantee,
+		AccessAddr: grant.AccessAddr,
+		WrappedKey: grant.WrappedKey,
+		Mode:       grant.Mode,
+		Time:       grant.Time,
+	})
+}
+
+// Collaborator is one edge of a file's sharing tree, as returned by
+// ListCollaborators: Grantor shared the file with Grantee at Time.
+type Collaborator struct {
+	Grantor string
+	Grantee string
+	Mode    Mode
+	Time    time.Time
+}
+
+// An access node: where a collaborator finds the SharingRecord, and
+// the write capability for read-write shares
+type accessNode struct {
+	ShRecordAddr string
+	SymmKey      []byte
+	WriteKey     userlib.SignKey
+}
+
+// What the owner of a file signs in SharingRecord.OwnerSig.  Binding
+// the address keeps a collaborator, who can rewrite the record, from
+// replaying the owner's signature on a record of their own.
+type ownershipClaim struct {
+	Owner        string
+	ShRecordAddr string
+	FileID       string
+	WritePub     userlib.VerifyKey
 }
 
+// What a writer signs in SharingRecord.WriteSig: the whole record,
+// bound to its address
+type writeClaim struct {
+	ShRecordAddr string
+	Record       SharingRecord
+}
+
+// Data blocks are signed by the user who wrote them.  The signature
+// covers the value and the file's FileID, not where the block is
+// stored, so blocks keep their author when a revocation moves them but
+// can't be copied into another file.
 type Data struct {
-	KeyAddr   string
 	Value     []byte
-	Signature []byte
+	Author    string
+	Nonce     []byte // random, so that a block can't be listed twice
+	Signature []byte // Author's signature over blockClaim
+
+	// A block made by Compact holds the blocks it merged instead, each
+	// still signed by its author.  Value is then only filled in memory.
+	Merged []Data
+
+	// Only in a merged block: WriteAt keeps what it didn't overwrite of
+	// a piece, leaving out Skip bytes at the front and Drop bytes at the
+	// back of the Value signed.  They can only ever shorten that.
+	Skip int
+	Drop int
+}
+
+// The separately signed pieces of a block
+func (data *Data) pieces() []Data {
+	if len(data.Merged) > 0 {
+		return data.Merged
+	}
+	return []Data{*data}
+}
+
+// The part of a piece's Value that is in the file
+func (data *Data) content() []byte {
+	return data.Value[data.Skip : len(data.Value)-data.Drop]
 }
 
-func remove(slice []byte, s int) []byte {
-	return append(slice[:s], slice[s+1:]...)
+// What the author of a Data block signs
+type blockClaim struct {
+	FileID string
+	Author string
+	Nonce  []byte
+	Value  []byte
+}
+
+// BlockAuthor attributes a range of a file to the user who wrote it,
+// as returned by LoadFileWithAuthors
+type BlockAuthor struct {
+	Author string
+	Offset int
+	Length int
 }
 
 //////////// DEBUG
@@ -92,6 +367,13 @@ func GetUserKey(username string, password string) string {
 	return userKey
 }
 
+// Derives the key sealing the User struct.  It is independent of the
+// address GetUserKey derives from the same credentials.
+func getUserSymKey(username string, password string) []byte {
+	return userlib.Argon2Key([]byte(password+username),
+		[]byte(username+"symmkey"), uint32(userlib.AESKeySize))
+}
+
 func (user *User) GetInodeKey(filename string) string {
 	// Generate the key corresponding to provided filename
 	passbyte := []byte((*user).Password + filename)
@@ -127,12 +409,15 @@ func (user *User) GetInodeKey(filename string) string {
 
 // You can assume the user has a STRONG password
 func InitUser(username string, password string) (userdataptr *User, err error) {
-	// Generate a Key for symmetric encryption and storage of User_r struct
+	return DefaultBackend.InitUser(username, password)
+}
+
+// InitUser creates a user whose session is bound to this backend.
+func (backend Backend) InitUser(username string,
+	password string) (userdataptr *User, err error) {
+	// Generate a Key for symmetric encryption and storage of User struct
 	userKey := GetUserKey(username, password)
-	userSymKey, err := hex.DecodeString(GetUserKey(password, username))
-	if err != nil {
-		return nil, errors.New(err.Error())
-	}
+	userSymKey := getUserSymKey(username, password)
 
 	// Generate RSA Public-Private Key Pair for the User
 	privKey, err := userlib.GenerateRSAKey()
@@ -140,449 +425,302 @@ func InitUser(username string, password string) (userdataptr *User, err error) {
 		return nil, errors.New("RSA Key-Pair generation failed")
 	}
 
-	// Push the RSA Public Key to secure Key-Store
-	userlib.KeystoreSet(username, privKey.PublicKey)
+	// The first user to claim a name keeps it forever, so don't
+	// overwrite the User struct of somebody who already has it
+	taken := fmt.Errorf("username %q: %w", username, ErrAlreadyExists)
+	if _, status := backend.keystore().Get(username); status {
+		return nil, taken
+	}
 
-	// Initialize the User structure without any signature
-	user := &User_r{
-		KeyAddr: userKey, // The key at which this struct will be stored
-		User: User{
-			Username: username,
-			Password: password,
-			Privkey:  privKey,
-		},
+	user := &User{
+		Username:  username,
+		Password:  password,
+		Privkey:   privKey,
+		RootKey:   newSymmKey(),
+		IndexAddr: newAddress(),
+		IndexKey:  newSymmKey(),
+		backend:   backend,
 	}
 
-	// Store the signature of User_r.User in User_r.Signature
-	userMarsh, err := json.Marshal(user.User)
+	// Seal the User struct, bound to its address, and push it to the
+	// Untrusted Data Store.  This comes before registering the key,
+	// which can't be undone: if it fails the name is still free.
+	err = storeSealed(backend.datastore(), userKey, userSymKey, user)
 	if err != nil {
-		return nil, errors.New("User_r.User Marshalling failed")
+		return nil, err
 	}
-	mac := userlib.NewHMAC(userSymKey)
-	mac.Write(userMarsh)
-	user.Signature = mac.Sum(nil)
 
-	// Finally, encrypt the whole thing
-	user_rMarsh, err := json.Marshal(user)
+	// Register the RSA Public Key with the Key-Store.  Without it the
+	// stored User is of no use (GetUser refuses it), so drop it again.
+	err = backend.keystore().Register(username, privKey.PublicKey)
 	if err != nil {
-		return nil, errors.New("User_r Marshalling failed")
+		backend.datastore().Delete(userKey)
+		if err == userlib.ErrKeyExists {
+			return nil, taken
+		}
+		return nil, err
 	}
 
-	ciphertext := make([]byte, BlockSize+len(user_rMarsh))
-	iv := ciphertext[:BlockSize]
-	copy(iv, userlib.RandomBytes(BlockSize))
-
-	// userlib.DebugMsg("Random IV", hex.EncodeToString(iv))
-	// NOTE: The "key" needs to be of 16 bytes
-	cipher := userlib.CFBEncrypter(userSymKey[:16], iv)
-	cipher.XORKeyStream(ciphertext[BlockSize:], []byte(user_rMarsh))
-
-	// Push the encrypted data to Untrusted Data Store
-	userlib.DatastoreDelete(userKey)
-	userlib.DatastoreSet(userKey, ciphertext)
-
-	return &user.User, nil
+	return user, nil
 }
 
 // This fetches the user information from the Datastore.  It should
 // fail with an error if the user/password is invalid, or if the user
 // data was corrupted, or if the user can't be found.
 func GetUser(username string, password string) (userdataptr *User, err error) {
-	// Retrieve the Key for symmetric encryption and storage of User_r struct
+	return DefaultBackend.GetUser(username, password)
+}
+
+// GetUser logs in a user whose session is bound to this backend.
+func (backend Backend) GetUser(username string,
+	password string) (userdataptr *User, err error) {
+	// Retrieve the Key for symmetric encryption and storage of User struct
 	userKey := GetUserKey(username, password)
-	userSymKey, err := hex.DecodeString(GetUserKey(password, username))
+	userSymKey := getUserSymKey(username, password)
+
+	// Now, retrieve and open the User struct and check if the
+	// credentials and integrity are properly maintained.
+	var user User
+	status, err := loadSealed(backend.datastore(), userKey, userSymKey, &user)
+	if !status && err != nil {
+		return nil, err
+	} else if !status {
+		// The address depends on the password, so a registered user
+		// with no record here means the password was wrong
+		if _, known := backend.keystore().Get(username); known {
+			return nil, ErrWrongCredentials
+		}
+		return nil, &NotFoundError{What: "user", Name: username}
+	}
 	if err != nil {
-		return nil, errors.New(err.Error())
+		return nil, integrityError(StructUser, err.Error())
 	}
 
-	// Now, retrieve and decrypt the User_r struct and check if the
-	// credentials and integrity are properly maintained.
-	ciphertext, status := userlib.DatastoreGet(userKey)
-	if status != true {
-		return nil, errors.New("User not found")
+	//
+	// Cool, after verifying the integrity, cross check the credentials
+	// just to be sure about user authentication
+	if username != user.Username || password != user.Password {
+		return nil, ErrWrongCredentials
+	}
+	if len(user.RootKey) != userlib.AESKeySize {
+		return nil, integrityError(StructUser, "bad root key")
 	}
 
-	iv := ciphertext[:BlockSize]
-	cipher := userlib.CFBDecrypter(userSymKey[:16], iv)
+	user.backend = backend
+	if err = user.checkKeystore(); err != nil {
+		return nil, err
+	}
+	if err = user.checkIndex(); err != nil {
+		return nil, err
+	}
 
-	// In place AES decryption of ciphertext
-	cipher.XORKeyStream(ciphertext[BlockSize:], ciphertext[BlockSize:])
+	// Everything works fine
+	return &user, nil
+}
 
-	var user User_r
-	err = json.Unmarshal(ciphertext[BlockSize:], &user)
-	if err != nil {
-		return nil, errors.New("User_r Unmarshalling failed")
+// The private key must belong to the key registered for the username,
+// otherwise nobody could verify what this session signs
+func (user *User) checkKeystore() error {
+	pubKey, status := user.keystore().Get(user.Username)
+	if !status || user.Privkey == nil ||
+		pubKey.E != user.Privkey.PublicKey.E ||
+		pubKey.N.Cmp(user.Privkey.PublicKey.N) != 0 {
+		return integrityError(StructUser,
+			"private key doesn't match the Key-Store")
 	}
+	return nil
+}
 
-	// Verify the User_r struct's integrity
-	userMarsh, err := json.Marshal(user.User)
-	if err != nil {
-		return nil, errors.New("User_r.User Marshalling failed")
+// Users created before the file index existed get one the first time
+// they log in, which means storing their User struct again
+func (user *User) checkIndex() error {
+	if user.IndexAddr != "" {
+		if len(user.IndexKey) != userlib.AESKeySize {
+			return integrityError(StructUser, "bad index key")
+		}
+		return nil
 	}
 
-	mac := userlib.NewHMAC(userSymKey)
-	mac.Write(userMarsh)
-	if !userlib.Equal(user.Signature, mac.Sum(nil)) {
-		return nil, errors.New("User Integrity check failed")
+	// A session saved before may be older than the stored User
+	userKey := GetUserKey(user.Username, user.Password)
+	userSymKey := getUserSymKey(user.Username, user.Password)
+	var stored User
+	status, err := loadSealed(user.datastore(), userKey, userSymKey, &stored)
+	if !status && err != nil {
+		return err
+	} else if !status {
+		return &NotFoundError{What: "user", Name: user.Username}
+	}
+	if err != nil {
+		return integrityError(StructUser, err.Error())
+	}
+	if stored.IndexAddr != "" {
+		user.IndexAddr, user.IndexKey = stored.IndexAddr, stored.IndexKey
+		return user.checkIndex()
 	}
 
-	//
-	// Cool, after verifying the integrity, cross check the credentials
-	// just to be sure about user authentication
-	if username != user.User.Username || password != user.User.Password {
-		return nil, errors.New("Error: User credentials don't match")
+	stored.IndexAddr, stored.IndexKey = newAddress(), newSymmKey()
+	err = storeSealed(user.datastore(), userKey, userSymKey, &stored)
+	if err != nil {
+		return err
 	}
+	user.IndexAddr, user.IndexKey = stored.IndexAddr, stored.IndexKey
+	return nil
+}
+
+// Session serializes a logged in user so that it can be resumed later
+// without repeating the (deliberately slow) GetUser.  The result holds
+// the password and private key in the clear: keep it private.
+func (user *User) Session() ([]byte, error) {
+	return json.Marshal(user)
+}
 
-	if userKey != user.KeyAddr {
-		return nil, errors.New("Error: Key-Value-Swap Attack")
+// ResumeSession restores a session saved with Session and binds it to
+// this backend.
+func (backend Backend) ResumeSession(session []byte) (userdataptr *User,
+	err error) {
+	var user User
+	err = json.Unmarshal(session, &user)
+	if err != nil {
+		return nil, fmt.Errorf("session unmarshalling failed: %v", err)
 	}
 
-	// Everything works fine
-	return &user.User, nil
+	user.backend = backend
+	if err = user.checkKeystore(); err != nil {
+		return nil, err
+	}
+	if err = user.checkIndex(); err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
 // This stores a file in the datastore.
 //
 // The name of the file should NOT be revealed to the datastore!
-func (user *User) StoreFile(filename string, data []byte) {
+//
+// Storing over an existing file (owned or shared with us) replaces its
+// contents for every collaborator.
+func (user *User) StoreFile(filename string, data []byte) (err error) {
 	///////////////////////////////////////
 	//           INODE STRUCTURE         //
 	///////////////////////////////////////
-	fileKey := user.GetInodeKey(filename)
-
-	// Check if the Inode for filename already exists
-	rsaEncrypted, status := userlib.DatastoreGet(fileKey)
-	if status {
-		//
-		// Since the Inode exists, we just need to overwrite the addess and
-		// symmetric keys at SharingRecord structure, apart from actually
-		// writing the data to DataStore
-		var encrypted [][]byte
-		err := json.Unmarshal(rsaEncrypted, &encrypted)
-		if err != nil {
-			return
-		}
-
-		// Retreive the Marshalled Inode_r struct from the encrypted chunks
-		index := 0
-		inodeMarsh := make([]byte, len(encrypted))
-		for index < len(encrypted) {
-			// RSA Asymmetric Key Decryption
-			decryptedBlock, err := userlib.RSADecrypt(user.Privkey,
-				encrypted[index], []byte("Tag"))
-			if err != nil {
-				return
-			}
-
-			inodeMarsh = append(inodeMarsh, decryptedBlock...)
-			index += 1
-		}
-
-		// Remove leading \x00 characters from inodeMarsh
-		for inodeMarsh[0] == []byte("\x00")[0] {
-			inodeMarsh = remove(inodeMarsh, 0)
-		}
-
-		var file Inode_r
-		err = json.Unmarshal(inodeMarsh, &file)
-		if err != nil {
-			return
-		}
-
-		// Verify Inode structure's integrity
-		fileMarsh, err := json.Marshal(file.Inode)
-		if err != nil {
-			return
-		}
-
-		err = userlib.RSAVerify(&user.Privkey.PublicKey, fileMarsh, file.Signature)
-		if err != nil {
-			return
-		}
-
-		//
+	_, file, err := user.loadInode(filename)
+	if err == nil {
 		///////////////////////////////////////
 		//      SHARINGRECORD STRUCTURE      //
 		///////////////////////////////////////
-		// Retrieve encrypted SharingRecord structure from DataStore
-		shrCipher, status := userlib.DatastoreGet(file.Inode.ShRecordAddr)
-		if !status {
-			return
-		}
-
-		iv := shrCipher[:BlockSize]
-		cipher := userlib.CFBDecrypter(file.Inode.SymmKey, iv)
-
-		// In place AES decryption of ciphertext
-		cipher.XORKeyStream(shrCipher[BlockSize:], shrCipher[BlockSize:])
-
-		var shrecord SharingRecord_r
-		err = json.Unmarshal(shrCipher[BlockSize:], &shrecord)
-		if err != nil {
-			return
-		}
-
-		// Verify the integrity of SharingRecord structure
-		shrMarsh, err := json.Marshal(shrecord.SharingRecord)
-		if err != nil {
-			return
-		}
-		mac := userlib.NewHMAC(file.Inode.SymmKey)
-		mac.Write(shrMarsh)
-		if !userlib.Equal(shrecord.Signature, mac.Sum(nil)) {
-			return
-		}
-
-		// Appending a new block
-		// Generate a random Initialization Vector and random address for
-		// encryption of Data Block to be stored in SharingRecord structure
-		randbyte, _ := json.Marshal(userlib.RandomBytes(BlockSize))
-		randbyte, _ = json.Marshal(randbyte) // Double shuffling to reduce collision
-		address := hex.EncodeToString(randbyte[:16])
-		var addr []string
-		var keys [][]byte
-
-		shrecord.SharingRecord.Address = append(addr, address)
-		shrecord.SharingRecord.SymmKey = append(keys, randbyte[:16])
-
-		//
-		// Now, Store the modified, encrypted and re-signed SharingRecord structure
-		// back to the DataStore
-		//
-
-		// HMAC Signature via symmetric keys
-		// Store the signature of SharingRecord_r.SharingRecord in Signature
-		shrMarsh, err = json.Marshal(shrecord.SharingRecord)
-		if err != nil {
-			return
-		}
-		mac = userlib.NewHMAC(file.Inode.SymmKey)
-		mac.Write(shrMarsh)
-		shrecord.Signature = mac.Sum(nil)
-
-		// Finally, encrypt the whole SharingRecord_r structure
-		shrecord_rMarsh, err := json.Marshal(shrecord)
-		if err != nil {
-			return
-		}
-
-		ciphertext := make([]byte, BlockSize+len(shrecord_rMarsh))
-		iv = ciphertext[:BlockSize]
-		copy(iv, userlib.RandomBytes(BlockSize))
-
-		// NOTE: The "key" needs to be of 16 bytes
-		cipher = userlib.CFBEncrypter(file.Inode.SymmKey, iv) // Check [:16]
-		cipher.XORKeyStream(ciphertext[BlockSize:], []byte(shrecord_rMarsh))
-
-		//
-		// Finally, push the data to be encrypted back to DataStore
-		///////////////////////////////////////
-		//           DATA STRUCTURE          //
-		///////////////////////////////////////
-		dbkey := randbyte[:16]
-
-		// HMAC Signature of data block via symmetric key
-		mac = userlib.NewHMAC(dbkey)
-		mac.Write(data)
-		hmacSum := mac.Sum(nil)
-
-		dblock := &Data{
-			// The key at which this struct will be stored
-			KeyAddr:   address,
-			Value:     data,
-			Signature: hmacSum,
-		}
-
-		// Finally, encrypt the whole data block using Symmetric Key
-		dblockMarsh, err := json.Marshal(dblock)
+		shrecord, err := user.loadSharingRecord(file)
 		if err != nil {
-			return
+			return err
 		}
 
-		cipherdata := make([]byte, BlockSize+len(dblockMarsh))
-		iv = cipherdata[:BlockSize]
-		copy(iv, userlib.RandomBytes(BlockSize))
-
-		// NOTE: The "key" needs to be of 16 bytes
-		cipher = userlib.CFBEncrypter(dbkey, iv)
-		cipher.XORKeyStream(cipherdata[BlockSize:], []byte(dblockMarsh))
-
-		//
-		// Push the AES-CFB Encrypted SharingRecord structure to Data Store
-		userlib.DatastoreDelete(file.Inode.ShRecordAddr)
-		userlib.DatastoreSet(file.Inode.ShRecordAddr, ciphertext)
-
-		// Push the AES-CFB Encrypted data block structure to Data Store
-		userlib.DatastoreDelete(address)
-		userlib.DatastoreSet(address, cipherdata)
+		// Since the Inode exists, we just need to overwrite the block
+		// list of the SharingRecord structure, apart from actually
+		// writing the data to DataStore
+		return user.rewrite("StoreFile", file, shrecord, data)
 	}
-
-	//
-	// Initialize the Inode structure without any signature (at the moment)
-	//
-
-	// Generate a random Initialization Vector and random address for
-	// encryption of SharingRecord Structure
-	iv := make([]byte, BlockSize)
-	copy(iv, userlib.RandomBytes(BlockSize))
-
-	randbyte, _ := json.Marshal(userlib.RandomBytes(BlockSize))
-	randbyte, _ = json.Marshal(randbyte)
-	address := hex.EncodeToString(randbyte[:16])
-
-	file := &Inode_r{
-		KeyAddr: fileKey, // The key at which this struct will be stored
-		Inode: Inode{
-			Filename:     filename,
-			ShRecordAddr: address,
-			SymmKey:      randbyte[:16],
-		},
+	if !missing(err, filename) {
+		return err
 	}
 
-	// Store the signature of Inode_r.Inode in Inode_r.Signature
-	fileMarsh, err := json.Marshal(file.Inode)
+	site, err := user.linkSite("StoreFile", filename)
 	if err != nil {
-		return
+		return err
 	}
-
-	file.Signature, err = userlib.RSASign(user.Privkey, fileMarsh)
+	file, written, err := user.newFile("StoreFile", filename, false, data)
 	if err != nil {
-		return
+		return err
 	}
+	return user.link(site, file, written)
+}
+
+// Creates the SharingRecord and data blocks of a new file (or
+// directory) owned by the user, and returns the Inode to link under
+// path along with what was written
+func (user *User) newFile(op string, path string, dir bool,
+	data []byte) (file *Inode, written []string, err error) {
+	//
+	// Initialize the Inode structure without any signature (at the moment)
+	//
 
-	// Finally, encrypt the whole Inode_r struct with User's Public key
-	inodeMarsh, err := json.Marshal(file)
+	// Generate a random key and address for the SharingRecord Structure,
+	// and the file's write capability
+	writePub, writeKey, err := userlib.GenerateSignKey()
 	if err != nil {
-		return
+		return nil, nil, errors.New("Write key generation failed")
 	}
 
-	// To store encrypted chunks
-	var encrypted [][]byte
-	var encryptedBlock []byte
-	index := 0
-
-	for index+190 <= len(inodeMarsh) {
-		// RSA Asymmetric Key Encryption
-		encryptedBlock, err = userlib.RSAEncrypt(&user.Privkey.PublicKey,
-			inodeMarsh[index:index+190], []byte("Tag"))
-		if err != nil {
-			return
-		}
-		index += 190
-		encrypted = append(encrypted, encryptedBlock)
+	file = &Inode{
+		Filename:     path,
+		Owner:        user.Username,
+		ShRecordAddr: newAddress(),
+		SymmKey:      newSymmKey(),
+		WriteKey:     writeKey,
+		Dir:          dir,
 	}
 
-	// In case the final chunk is not a multiple of 190
-	encryptedBlock, err = userlib.RSAEncrypt(&user.Privkey.PublicKey,
-		inodeMarsh[index:], []byte("Tag"))
-	if err != nil {
-		return
+	shrecord := &SharingRecord{
+		Type:       fileRecord,
+		MainAuthor: user.Username,
+		FileID:     newAddress(),
+		WritePub:   writePub,
 	}
-	encrypted = append(encrypted, encryptedBlock)
-
-	encryptedMarsh, err := json.Marshal(encrypted)
-	if err != nil {
-		return
+	if dir {
+		shrecord.Type = dirRecord
 	}
 
-	//
-	///////////////////////////////////////
-	//      SHARINGRECORD STRUCTURE      //
-	///////////////////////////////////////
-
-	var addr []string
-	var keys [][]byte
-
-	// Generate a random Initialization Vector and random address for
-	// encryption of Data Block to be stored in SharingRecord structure
-	randbyte, _ = json.Marshal(userlib.RandomBytes(BlockSize))
-	randbyte, _ = json.Marshal(randbyte)
-	address = hex.EncodeToString(randbyte[:16])
-
-	// Here, we append the first block of data to the list of blocks
-	// The address and the encryption key for the block
-	addr = append(addr, address)
-	keys = append(keys, randbyte[:16])
-
-	shrecord := &SharingRecord_r{
-		KeyAddr: file.Inode.ShRecordAddr, // The key at which this struct will be stored
-		SharingRecord: SharingRecord{
-			Type:       "Sharing Record",
-			MainAuthor: user.Username,
-			Address:    addr,
-			SymmKey:    keys,
-		},
+	// Push the data blocks first
+	blocks := blockList{fileID: shrecord.FileID}
+	if err = user.storeChunks(op, &blocks, data); err != nil {
+		return nil, nil, err
 	}
 
-	// HMAC Signature via symmetric keys
-	// Store the signature of SharingRecord_r.SharingRecord in Signature
-	shrMarsh, err := json.Marshal(shrecord.SharingRecord)
+	// Here, we add the data blocks to the list of blocks: the address
+	// and the encryption key for each block
+	blocks.appendTo(shrecord)
+	err = user.signOwnership(file, shrecord)
 	if err != nil {
-		return
+		return nil, nil, &WriteError{Op: op,
+			Leftover: blocks.address, Err: err}
 	}
-	mac := userlib.NewHMAC(file.Inode.SymmKey)
-	mac.Write(shrMarsh)
-	shrecord.Signature = mac.Sum(nil)
 
-	// Finally, encrypt the whole SharingRecord_r structure
-	shrecord_rMarsh, err := json.Marshal(shrecord)
+	// Then the SharingRecord; linking the Inode makes the file visible
+	err = user.storeSharingRecord(file, shrecord)
 	if err != nil {
-		return
+		return nil, nil, &WriteError{Op: op,
+			Leftover: blocks.address, Err: err}
 	}
+	return file, append(blocks.address, file.ShRecordAddr), nil
+}
 
-	ciphertext := make([]byte, BlockSize+len(shrecord_rMarsh))
-	iv = ciphertext[:BlockSize]
-	copy(iv, userlib.RandomBytes(BlockSize))
-
-	// NOTE: The "key" needs to be of 16 bytes
-	cipher := userlib.CFBEncrypter(file.Inode.SymmKey, iv) // Check [:16]
-	cipher.XORKeyStream(ciphertext[BlockSize:], []byte(shrecord_rMarsh))
+// Replaces the contents of a file with data.  The new blocks go first,
+// then the SharingRecord (the commit point), after which the old blocks
+// can go.
+func (user *User) rewrite(op string, file *Inode, shrecord *SharingRecord,
+	data []byte) error {
+	if file.WriteKey == nil {
+		return &PermissionError{Op: op, Name: file.Filename,
+			Reason: "read-only share"}
+	}
 
-	//
 	///////////////////////////////////////
 	//           DATA STRUCTURE          //
 	///////////////////////////////////////
-	dbkey := shrecord.SharingRecord.SymmKey[0]
-
-	// HMAC Signature of data block via symmetric key
-	mac = userlib.NewHMAC(dbkey)
-	mac.Write(data)
-	hmacSum := mac.Sum(nil)
-
-	dblock := &Data{
-		// The key at which this struct will be stored
-		KeyAddr:   shrecord.SharingRecord.Address[0],
-		Value:     data,
-		Signature: hmacSum,
+	blocks := blockList{fileID: shrecord.FileID}
+	if err := user.storeChunks(op, &blocks, data); err != nil {
+		return err
 	}
+	garbage := shrecord.Address
+	shrecord.Address, shrecord.SymmKey = nil, nil
+	shrecord.Hashes, shrecord.Lengths = nil, nil
+	blocks.appendTo(shrecord)
 
-	// Finally, encrypt the whole data block using Symmetric Key
-	dblockMarsh, err := json.Marshal(dblock)
+	err := user.storeSharingRecord(file, shrecord)
 	if err != nil {
-		return
+		return &WriteError{Op: op, Leftover: blocks.address, Err: err}
 	}
-
-	cipherdata := make([]byte, BlockSize+len(dblockMarsh))
-	iv = cipherdata[:BlockSize]
-	copy(iv, userlib.RandomBytes(BlockSize))
-
-	// NOTE: The "key" needs to be of 16 bytes
-	cipher = userlib.CFBEncrypter(dbkey, iv)
-	cipher.XORKeyStream(cipherdata[BlockSize:], []byte(dblockMarsh))
-
-	//
-	// Push the RSA Encrypted Inode structure to Data Store
-	userlib.DatastoreDelete(fileKey)
-	userlib.DatastoreSet(fileKey, encryptedMarsh)
-
-	// Push the AES-CFB Encrypted SharingRecord structure to Data Store
-	userlib.DatastoreDelete(file.Inode.ShRecordAddr)
-	userlib.DatastoreSet(file.Inode.ShRecordAddr, ciphertext)
-
-	// Push the AES-CFB Encrypted data block structure to Data Store
-	userlib.DatastoreDelete(shrecord.SharingRecord.Address[0])
-	userlib.DatastoreSet(shrecord.SharingRecord.Address[0], cipherdata)
-
+	return user.deleteGarbage(op, garbage)
 }
 
 // This adds on to an existing file.
@@ -594,941 +732,1358 @@ func (user *User) AppendFile(filename string, data []byte) (err error) {
 	///////////////////////////////////////
 	//           INODE STRUCTURE         //
 	///////////////////////////////////////
-	fileKey := user.GetInodeKey(filename)
-
-	// Retrieve the encrypted Inode structure from DataStore
-	rsaEncrypted, status := userlib.DatastoreGet(fileKey)
-	if status != true {
-		return errors.New("Filename not found")
+	_, file, err := user.loadInode(filename)
+	if err != nil {
+		return err
 	}
 
-	var encrypted [][]byte
-	err = json.Unmarshal(rsaEncrypted, &encrypted)
+	///////////////////////////////////////
+	//      SHARINGRECORD STRUCTURE      //
+	///////////////////////////////////////
+	shrecord, err := user.loadSharingRecord(file)
 	if err != nil {
-		return errors.New("Inode_r Unmarshalling failed")
+		return err
+	}
+	if file.WriteKey == nil {
+		return &PermissionError{Op: "AppendFile", Name: filename,
+			Reason: "read-only share"}
 	}
 
-	// Retreive the Marshalled Inode_r struct from the encrypted chunks
-	index := 0
-	inodeMarsh := make([]byte, len(encrypted))
-	for index < len(encrypted) {
-		// RSA Asymmetric Key Decryption
-		decryptedBlock, err := userlib.RSADecrypt(user.Privkey,
-			encrypted[index], []byte("Tag"))
-		if err != nil {
-			return errors.New("RSA Encryption of Inode_r failed\n")
-		}
-
-		inodeMarsh = append(inodeMarsh, decryptedBlock...)
-		index += 1
+	if len(data) == 0 {
+		return nil
 	}
 
-	// Remove leading \x00 characters from inodeMarsh
-	for inodeMarsh[0] == []byte("\x00")[0] {
-		inodeMarsh = remove(inodeMarsh, 0)
+	// Appending new blocks, each with a random key and address, to be
+	// stored in SharingRecord structure
+	///////////////////////////////////////
+	//           DATA STRUCTURE          //
+	///////////////////////////////////////
+	blocks := blockList{fileID: shrecord.FileID}
+	if err = user.storeChunks("AppendFile", &blocks, data); err != nil {
+		return err
 	}
+	before := len(shrecord.Address)
+	blocks.appendTo(shrecord)
 
-	var file Inode_r
-	err = json.Unmarshal(inodeMarsh, &file)
+	// Now, Store the modified, encrypted and re-signed SharingRecord
+	// structure back to the DataStore
+	err = user.storeSharingRecord(file, shrecord)
 	if err != nil {
-		return errors.New("Inode_r Unmarshalling failed")
+		return &WriteError{Op: "AppendFile",
+			Leftover: blocks.address, Err: err}
 	}
+	user.autoCompact(filename, before, len(shrecord.Address))
+	return nil
+}
 
-	// Verify Inode structure's integrity
-	fileMarsh, err := json.Marshal(file.Inode)
+// This loads a file from the Datastore.
+//
+// It should give an error if the file is corrupted in any way.
+func (user *User) LoadFile(filename string) (data []byte, err error) {
+	data, _, err = user.LoadFileWithAuthors(filename)
+	return data, err
+}
+
+// LoadFileWithAuthors loads a file like LoadFile and also reports who
+// wrote each of its blocks.  A block signed for another file, or listed
+// twice, fails the integrity check.
+func (user *User) LoadFileWithAuthors(filename string) (data []byte,
+	authors []BlockAuthor, err error) {
+	///////////////////////////////////////
+	//           INODE STRUCTURE         //
+	///////////////////////////////////////
+	_, file, err := user.loadInode(filename)
 	if err != nil {
-		return errors.New("Inode_r.Inode Marshalling failed")
+		return nil, nil, err
 	}
 
-	err = userlib.RSAVerify(&user.Privkey.PublicKey, fileMarsh, file.Signature)
+	///////////////////////////////////////
+	//      SHARINGRECORD STRUCTURE      //
+	///////////////////////////////////////
+	shrecord, err := user.loadSharingRecord(file)
 	if err != nil {
-		return errors.New("Inode Integrity Check failed")
+		return nil, nil, err
 	}
 
 	//
+	// Loop through all data blocks, run the checks and return them
 	///////////////////////////////////////
-	//      SHARINGRECORD STRUCTURE      //
+	//           DATA STRUCTURE          //
 	///////////////////////////////////////
-	// Retrieve encrypted SharingRecord structure from DataStore
-	shrCipher, status := userlib.DatastoreGet(file.Inode.ShRecordAddr)
-	if !status {
-		return errors.New("Sharing Record Structure can't be found")
+	var finalData []byte
+	used := make(map[string]int) // by nonce, where the last use ended
+	for i := range shrecord.Address {
+		block, err := user.loadBlock(shrecord, i)
+		if err != nil {
+			return nil, nil, user.blockGone(filename, shrecord, err)
+		}
+		for _, piece := range block.pieces() {
+			// A writer could list somebody's block a second time.  The
+			// parts WriteAt left of one must not overlap, and stay in
+			// order.
+			if end, ok := used[string(piece.Nonce)]; ok && piece.Skip < end {
+				return nil, nil, &IntegrityError{StructData, i,
+					"block listed twice"}
+			}
+			used[string(piece.Nonce)] = len(piece.Value) - piece.Drop
+			authors = append(authors, BlockAuthor{
+				Author: piece.Author,
+				Offset: len(finalData),
+				Length: len(piece.content()),
+			})
+			finalData = append(finalData, piece.content()...)
+		}
 	}
 
-	iv := shrCipher[:BlockSize]
-	cipher := userlib.CFBDecrypter(file.Inode.SymmKey, iv)
+	return finalData, authors, nil
+}
 
-	// In place AES decryption of ciphertext
-	cipher.XORKeyStream(shrCipher[BlockSize:], shrCipher[BlockSize:])
+// Removes a file from the caller's namespace.
+//
+// When the owner deletes a file it is gone for everybody: the
+// SharingRecord, every data block and every access node are deleted.
+// A collaborator only drops their own share; the file stays as it is
+// for everybody else.  In a shared directory nobody but the owner may
+// delete a file, see checkUnlink.
+func (user *User) DeleteFile(filename string) (err error) {
+	fileKey, file, err := user.loadInode(filename)
+	if brokenInode(err) {
+		// Whatever is left of it can only go by name
+		uerr := user.unlink("DeleteFile", filename, "")
+		if errors.Is(uerr, ErrNotFound) {
+			return err
+		}
+		return uerr
+	} else if err != nil {
+		return err
+	}
+	return user.remove("DeleteFile", filename, fileKey, file)
+}
 
-	var shrecord SharingRecord_r
-	err = json.Unmarshal(shrCipher[BlockSize:], &shrecord)
-	if err != nil {
-		return errors.New("SharingRecord_r Unmarshalling failed")
+// Takes a file or directory out of the caller's namespace, which is the
+// commit point.  If the caller owns it, its SharingRecord, data blocks
+// and access nodes go as well.
+func (user *User) remove(op string, path string, fileKey string,
+	file *Inode) error {
+	if err := user.checkUnlink(op, path, file); err != nil {
+		return err
+	}
+	var garbage []string
+	if file.AccessAddr == "" && file.Owner == user.Username {
+		// If the SharingRecord can't be opened, the blocks can't be
+		// found either and are left behind
+		garbage = append(garbage, file.ShRecordAddr)
+		shrecord, err := user.loadSharingRecord(file)
+		if err == nil {
+			garbage = append(garbage, shrecord.Address...)
+			for _, grant := range user.verifiedGrants(shrecord) {
+				garbage = append(garbage, grant.AccessAddr)
+			}
+		}
+	}
+	if err := user.unlink(op, path, fileKey); err != nil {
+		return err
 	}
+	return user.deleteGarbage(op, garbage)
+}
 
-	// Verify the integrity of SharingRecord structure
-	shrMarsh, err := json.Marshal(shrecord.SharingRecord)
+// Gives a file or directory a new name in the caller's namespace,
+// possibly in another directory.  Only the Inode moves: the
+// SharingRecord and the blocks stay where they are, so collaborators
+// don't notice.  The Inode is linked under the new name before the old
+// one is unlinked, so a failure in between leaves the file under both
+// names rather than under none.
+func (user *User) RenameFile(oldname string, newname string) (err error) {
+	oldKey, file, err := user.lookup(oldname)
 	if err != nil {
-		return errors.New("SharingRecord_r.SharingRecord Marshalling failed")
+		return err
+	}
+	if newname == oldname {
+		return nil
 	}
-	mac := userlib.NewHMAC(file.Inode.SymmKey)
-	mac.Write(shrMarsh)
-	if !userlib.Equal(shrecord.Signature, mac.Sum(nil)) {
-		return errors.New("SharingRecord Integrity check failed")
+	if file.Dir && strings.HasPrefix(newname, oldname+"/") {
+		return fmt.Errorf("can't move %q into itself", oldname)
 	}
 
-	// Appending a new block
-	// Generate a random Initialization Vector and random address for
-	// encryption of Data Block to be stored in SharingRecord structure
-	randbyte, _ := json.Marshal(userlib.RandomBytes(BlockSize))
-	randbyte, _ = json.Marshal(randbyte)
-	address := hex.EncodeToString(randbyte[:16])
-
-	shrecord.SharingRecord.Address = append(shrecord.SharingRecord.Address, address)
-	shrecord.SharingRecord.SymmKey = append(shrecord.SharingRecord.SymmKey, randbyte[:16])
-
-	//
-	// Now, Store the modified, encrypted and re-signed SharingRecord structure
-	// back to the DataStore
-	//
-
-	// HMAC Signature via symmetric keys
-	// Store the signature of SharingRecord_r.SharingRecord in Signature
-	shrMarsh, err = json.Marshal(shrecord.SharingRecord)
-	if err != nil {
-		return errors.New("SharingRecord_r.SharingRecord Marshalling failed")
+	if file.parent != nil && file.parent.WriteKey == nil {
+		return &PermissionError{Op: "RenameFile",
+			Name: file.parent.Filename, Reason: "read-only share"}
+	}
+	if err = user.checkUnlink("RenameFile", oldname, file); err != nil {
+		return err
 	}
-	mac = userlib.NewHMAC(file.Inode.SymmKey)
-	mac.Write(shrMarsh)
-	shrecord.Signature = mac.Sum(nil)
 
-	// Finally, encrypt the whole SharingRecord_r structure
-	shrecord_rMarsh, err := json.Marshal(shrecord)
+	site, err := user.linkSite("RenameFile", newname)
 	if err != nil {
-		return errors.New("SharingRecord_r Marshalling failed")
+		return err
 	}
-
-	ciphertext := make([]byte, BlockSize+len(shrecord_rMarsh))
-	iv = ciphertext[:BlockSize]
-	copy(iv, userlib.RandomBytes(BlockSize))
-
-	// NOTE: The "key" needs to be of 16 bytes
-	cipher = userlib.CFBEncrypter(file.Inode.SymmKey, iv) // Check [:16]
-	cipher.XORKeyStream(ciphertext[BlockSize:], []byte(shrecord_rMarsh))
-
-	//
-	// Finally, push the data to be encrypted back to DataStore
-	///////////////////////////////////////
-	//           DATA STRUCTURE          //
-	///////////////////////////////////////
-	dbkey := randbyte[:16]
-
-	// HMAC Signature of data block via symmetric key
-	mac = userlib.NewHMAC(dbkey)
-	mac.Write(data)
-	hmacSum := mac.Sum(nil)
-
-	dblock := &Data{
-		// The key at which this struct will be stored
-		KeyAddr:   address,
-		Value:     data,
-		Signature: hmacSum,
+	if err = user.link(site, file, nil); err != nil {
+		return err
+	}
+	if err = user.unlink("RenameFile", oldname, oldKey); err != nil {
+		// The old name still works, nothing is left behind
+		return &WriteError{Op: "RenameFile", Committed: true, Err: err}
 	}
+	return nil
+}
 
-	// Finally, encrypt the whole data block using Symmetric Key
-	dblockMarsh, err := json.Marshal(dblock)
-	if err != nil {
-		return errors.New("Data block Marshalling failed")
+// Deletes values a committed operation no longer refers to
+func (user *User) deleteGarbage(op string, garbage []string) error {
+	for i, address := range garbage {
+		if err := user.datastore().Delete(address); err != nil {
+			return &WriteError{Op: op, Committed: true,
+				Leftover: garbage[i:], Err: err}
+		}
 	}
+	return nil
+}
 
-	cipherdata := make([]byte, BlockSize+len(dblockMarsh))
-	iv = cipherdata[:BlockSize]
-	copy(iv, userlib.RandomBytes(BlockSize))
+// What a msgid carries, signed by the sender
+type sharingInfo struct {
+	Recipient  string
+	Owner      string
+	AccessAddr string
+	AccessKey  []byte
+	Dir        bool
+}
 
-	// NOTE: The "key" needs to be of 16 bytes
-	cipher = userlib.CFBEncrypter(dbkey, iv) // Check [:16]
-	cipher.XORKeyStream(cipherdata[BlockSize:], []byte(dblockMarsh))
+// This creates a sharing record, which is a key pointing to something
+// in the datastore to share with the recipient.
 
-	//
-	// Push the AES-CFB Encrypted SharingRecord structure to Data Store
-	userlib.DatastoreDelete(file.Inode.ShRecordAddr)
-	userlib.DatastoreSet(file.Inode.ShRecordAddr, ciphertext)
+// This enables the recipient to access the encrypted file as well
+// for reading/appending.
 
-	// Push the AES-CFB Encrypted data block structure to Data Store
-	userlib.DatastoreDelete(address)
-	userlib.DatastoreSet(address, cipherdata)
+// Note that neither the recipient NOR the datastore should gain any
+// information about hat the sender calls the file.  Only the
+// recipient can access the sharing record, and only the recipient
+// should be able to know the sender.
 
-	return nil
+// Every share gets its own access node and is recorded as a Grant in
+// the SharingRecord, so that it can later be revoked on its own.
+//
+// Sharing a directory shares everything under it, including whatever
+// is created there later: the recipient mounts the directory with a
+// single ReceiveFile.
+//
+// ShareFile grants read-write access, see ShareFileWithMode.
+func (user *User) ShareFile(filename string, recipient string) (
+	msgid string, err error) {
+	return user.ShareFileWithMode(filename, recipient, ReadWrite)
 }
 
-// This loads a file from the Datastore.
-//
-// It should give an error if the file is corrupted in any way.
-func (user *User) LoadFile(filename string) (data []byte, err error) {
+// ShareFileWithMode shares a file like ShareFile, granting the
+// recipient either ReadWrite or ReadOnly access.  Sharing is a write
+// to the file, so read-only collaborators can't share it further.
+func (user *User) ShareFileWithMode(filename string, recipient string,
+	mode Mode) (msgid string, err error) {
+	if mode != ReadWrite && mode != ReadOnly {
+		return "", fmt.Errorf("unknown sharing mode %d", mode)
+	}
+
 	///////////////////////////////////////
 	//           INODE STRUCTURE         //
 	///////////////////////////////////////
-	fileKey := user.GetInodeKey(filename)
-
-	// Retrieve the encrypted Inode structure from DataStore
-	rsaEncrypted, status := userlib.DatastoreGet(fileKey)
-	if status != true {
-		return nil, errors.New("Filename not found")
+	_, file, err := user.lookup(filename)
+	if err != nil {
+		return "", err
 	}
 
-	var encrypted [][]byte
-	err = json.Unmarshal(rsaEncrypted, &encrypted)
+	///////////////////////////////////////
+	//      SHARINGRECORD STRUCTURE      //
+	///////////////////////////////////////
+	shrecord, err := user.loadSharingRecord(file)
 	if err != nil {
-		return nil, errors.New("Inode_r Unmarshalling failed")
+		return "", err
+	}
+	if file.WriteKey == nil {
+		return "", &PermissionError{Op: "ShareFile", Name: filename,
+			Reason: "read-only share"}
 	}
 
-	// Retreive the Marshalled Inode_r struct from the encrypted chunks
-	index := 0
-	inodeMarsh := make([]byte, len(encrypted))
-	for index < len(encrypted) {
-		// RSA Asymmetric Key Decryption
-		decryptedBlock, err := userlib.RSADecrypt(user.Privkey,
-			encrypted[index], []byte("Tag"))
+	// Loop through all data blocks, run the checks on them
+	///////////////////////////////////////
+	//           DATA STRUCTURE          //
+	///////////////////////////////////////
+	for i := range shrecord.Address {
+		_, err := user.loadBlock(shrecord, i)
 		if err != nil {
-			return nil, errors.New("RSA Encryption of Inode_r failed\n")
+			return "", err
 		}
-
-		inodeMarsh = append(inodeMarsh, decryptedBlock...)
-		index += 1
 	}
 
-	// Remove leading \x00 characters from inodeMarsh
-	for inodeMarsh[0] == []byte("\x00")[0] {
-		inodeMarsh = remove(inodeMarsh, 0)
+	recvPubKey, status := user.keystore().Get(recipient)
+	if !status {
+		return "", &NotFoundError{What: "recipient", Name: recipient}
 	}
 
-	var file Inode_r
-	err = json.Unmarshal(inodeMarsh, &file)
+	// A fresh access node for the recipient, recorded in the sharing
+	// tree under our name
+	accessAddr, accessKey := newAddress(), newSymmKey()
+	grant, err := user.newGrant(shrecord, recipient, mode, accessAddr,
+		accessKey)
 	if err != nil {
-		return nil, errors.New("Inode_r Unmarshalling failed")
+		return "", err
 	}
+	shrecord.Grants = append(shrecord.Grants, *grant)
 
-	// Verify Inode structure's integrity
-	fileMarsh, err := json.Marshal(file.Inode)
+	err = storeSealed(user.datastore(), accessAddr, accessKey,
+		newAccessNode(file, mode))
 	if err != nil {
-		return nil, errors.New("Inode_r.Inode Marshalling failed")
+		return "", &WriteError{Op: "ShareFile", Err: err}
 	}
-
-	err = userlib.RSAVerify(&user.Privkey.PublicKey, fileMarsh, file.Signature)
+	err = user.storeSharingRecord(file, shrecord)
 	if err != nil {
-		return nil, errors.New("Inode Integrity Check failed")
+		return "", &WriteError{Op: "ShareFile",
+			Leftover: []string{accessAddr}, Err: err}
 	}
 
 	//
-	///////////////////////////////////////
-	//      SHARINGRECORD STRUCTURE      //
-	///////////////////////////////////////
-	// Retrieve encrypted SharingRecord structure from DataStore
-	shrCipher, status := userlib.DatastoreGet(file.Inode.ShRecordAddr)
-	if !status {
-		return nil, errors.New("Sharing Record Structure can't be found")
+	// Find collected_info and return after appropriate verification
+	collected_info := sharingInfo{
+		Recipient:  recipient,
+		Owner:      file.Owner,
+		AccessAddr: accessAddr,
+		AccessKey:  accessKey,
+		Dir:        file.Dir,
 	}
 
-	iv := shrCipher[:BlockSize]
-	cipher := userlib.CFBDecrypter(file.Inode.SymmKey, iv)
-
-	// In place AES decryption of ciphertext
-	cipher.XORKeyStream(shrCipher[BlockSize:], shrCipher[BlockSize:])
+	return sealMessage(user.Privkey, &recvPubKey, collected_info)
+}
 
-	var shrecord SharingRecord_r
-	err = json.Unmarshal(shrCipher[BlockSize:], &shrecord)
+// Note recipient's filename can be different from the sender's filename.
+// The recipient should not be able to discover the sender's view on
+// what the filename even is!  However, the recipient must ensure that
+// it is authentically from the sender.
+func (user *User) ReceiveFile(filename string, sender string,
+	msgid string) error {
+	site, err := user.linkSite("ReceiveFile", filename)
 	if err != nil {
-		return nil, errors.New("SharingRecord_r Unmarshalling failed")
+		return err
+	}
+
+	// Retrieve sender's public key
+	sendPubKey, status := user.keystore().Get(sender)
+	if !status {
+		return &NotFoundError{What: "sender", Name: sender}
 	}
 
-	// Verify the integrity of SharingRecord structure
-	shrMarsh, err := json.Marshal(shrecord.SharingRecord)
+	var collected_info sharingInfo
+	err = openMessage(user.Privkey, &sendPubKey, msgid, &collected_info)
 	if err != nil {
-		return nil, errors.New("SharingRecord_r.SharingRecord Marshalling failed")
+		return err
 	}
-	mac := userlib.NewHMAC(file.Inode.SymmKey)
-	mac.Write(shrMarsh)
-	if !userlib.Equal(shrecord.Signature, mac.Sum(nil)) {
-		return nil, errors.New("SharingRecord Integrity check failed")
+	if collected_info.Recipient != user.Username ||
+		len(collected_info.AccessKey) != userlib.AESKeySize {
+		return integrityError(StructMsgid, "not meant for "+user.Username)
 	}
 
-	//
-	// Loop through all data blocks, run the checks and return them
 	///////////////////////////////////////
-	//           DATA STRUCTURE          //
+	//           INODE STRUCTURE         //
 	///////////////////////////////////////
-	numBlocks := len(shrecord.SharingRecord.SymmKey)
-	var finalData []byte
-
-	for i := 0; i < numBlocks; i += 1 {
-		dbKey := shrecord.SharingRecord.Address[i]
-		symmKey := shrecord.SharingRecord.SymmKey[i]
-
-		ciphertext, status := userlib.DatastoreGet(dbKey)
-		if status != true {
-			return nil, errors.New("Data block not found")
-		}
-
-		iv := ciphertext[:BlockSize]
-		cipher := userlib.CFBDecrypter(symmKey, iv)
-
-		// In place AES decryption of ciphertext
-		cipher.XORKeyStream(ciphertext[BlockSize:],
-			ciphertext[BlockSize:])
-
-		var data Data
-		err = json.Unmarshal(ciphertext[BlockSize:], &data)
-		if err != nil {
-			return nil, errors.New("Data block Unmarshalling failed")
-		}
-
-		// Check the data integrity
-		mac := userlib.NewHMAC(symmKey)
-		mac.Write(data.Value)
-		hmacSum := mac.Sum(nil)
-		if !userlib.Equal(data.Signature, hmacSum) {
-			return nil, errors.New("Data Integrity check failed")
-		}
-
-		// Key-value swap check
-		if dbKey != data.KeyAddr {
-			return nil, errors.New("Key Value swap detected")
-		}
-
-		finalData = append(finalData, data.Value...)
+	//
+	// Here, after verifying the integrity of the msgid, we add the
+	// recieved info about our access node in the new inode
+	file := &Inode{
+		Filename:   filename,
+		Owner:      collected_info.Owner,
+		AccessAddr: collected_info.AccessAddr,
+		AccessKey:  collected_info.AccessKey,
+		Receiver:   user.Username,
+		Dir:        collected_info.Dir,
 	}
 
-	return finalData, nil
+	// Make sure the share is live and really belongs to its owner
+	_, err = user.loadSharingRecord(file)
+	if err != nil {
+		return err
+	}
 
+	return user.link(site, file, nil)
 }
 
-// This creates a sharing record, which is a key pointing to something
-// in the datastore to share with the recipient.
-
-// This enables the recipient to access the encrypted file as well
-// for reading/appending.
-
-// Note that neither the recipient NOR the datastore should gain any
-// information about hat the sender calls the file.  Only the
-// recipient can access the sharing record, and only the recipient
-// should be able to know the sender.
-
-func (user *User) ShareFile(filename string, recipient string) (
-	msgid string, err error) {
+// Removes access for all others.  Only the owner of a file may revoke
+// it; anybody else gets a PermissionError.
+//
+// Revoking a directory also moves everything under it that the owner
+// owns (see rekeyEntries).  Files that collaborators created in it
+// keep their keys, so revoked users who knew them can still read and,
+// with write access to the directory, write them until their owners
+// revoke them as well.
+func (user *User) RevokeFile(filename string) (err error) {
 	///////////////////////////////////////
 	//           INODE STRUCTURE         //
 	///////////////////////////////////////
-	fileKey := user.GetInodeKey(filename)
-
-	// Retrieve the encrypted Inode structure from DataStore
-	rsaEncrypted, status := userlib.DatastoreGet(fileKey)
-	if status != true {
-		return "", errors.New("Filename not found")
+	fileKey, file, err := user.lookup(filename)
+	if err != nil {
+		return err
 	}
 
-	var encrypted [][]byte
-	err = json.Unmarshal(rsaEncrypted, &encrypted)
+	///////////////////////////////////////
+	//      SHARINGRECORD STRUCTURE      //
+	///////////////////////////////////////
+	shrecord, err := user.loadSharingRecord(file)
 	if err != nil {
-		return "", errors.New("Inode_r Unmarshalling failed")
+		return err
 	}
-
-	// Retreive the Marshalled Inode_r struct from the encrypted chunks
-	index := 0
-	inodeMarsh := make([]byte, len(encrypted))
-	for index < len(encrypted) {
-		// RSA Asymmetric Key Decryption
-		decryptedBlock, err := userlib.RSADecrypt(user.Privkey,
-			encrypted[index], []byte("Tag"))
-		if err != nil {
-			return "", errors.New("RSA Encryption of Inode_r failed\n")
-		}
-
-		inodeMarsh = append(inodeMarsh, decryptedBlock...)
-		index += 1
+	if shrecord.MainAuthor != user.Username {
+		return &PermissionError{Op: "RevokeFile", Name: filename,
+			Reason: "owned by " + shrecord.MainAuthor}
 	}
 
-	// Remove leading \x00 characters from inodeMarsh
-	for inodeMarsh[0] == []byte("\x00")[0] {
-		inodeMarsh = remove(inodeMarsh, 0)
-	}
+	// Nobody keeps a grant
+	return user.rekey("RevokeFile", fileKey, file, shrecord, nil)
+}
 
-	var file Inode_r
-	err = json.Unmarshal(inodeMarsh, &file)
+// Removes username's access to a file along with everybody username
+// shared it with (directly or further down the sharing tree), unless
+// they were also granted access by somebody else.  The remaining
+// collaborators keep their access.  Only the owner may do this.
+// Directories are revoked as in RevokeFile.
+func (user *User) RevokeUser(filename string, username string) (err error) {
+	fileKey, file, err := user.lookup(filename)
 	if err != nil {
-		return "", errors.New("Inode_r Unmarshalling failed")
+		return err
 	}
-
-	// Verify Inode structure's integrity
-	fileMarsh, err := json.Marshal(file.Inode)
+	shrecord, err := user.loadSharingRecord(file)
 	if err != nil {
-		return "", errors.New("Inode_r.Inode Marshalling failed")
+		return err
 	}
-
-	err = userlib.RSAVerify(&user.Privkey.PublicKey, fileMarsh, file.Signature)
-	if err != nil {
-		return "", errors.New("Inode Integrity Check failed")
+	if shrecord.MainAuthor != user.Username {
+		return &PermissionError{Op: "RevokeUser", Name: filename,
+			Reason: "owned by " + shrecord.MainAuthor}
 	}
-
-	//
-	///////////////////////////////////////
-	//      SHARINGRECORD STRUCTURE      //
-	///////////////////////////////////////
-	// Retrieve encrypted SharingRecord structure from DataStore
-	shrCipher, status := userlib.DatastoreGet(file.Inode.ShRecordAddr)
-	if !status {
-		return "", errors.New("Sharing Record Structure can't be found")
+	if username == user.Username {
+		return &PermissionError{Op: "RevokeUser", Name: filename,
+			Reason: "cannot revoke the owner"}
 	}
 
-	iv := shrCipher[:BlockSize]
-	cipher := userlib.CFBDecrypter(file.Inode.SymmKey, iv)
+	// Grants come after the grant that gave their grantor access, so
+	// a single pass finds who keeps access: the owner and whoever the
+	// kept read-write grants reach.  Somebody in username's subtree
+	// who was also granted access some other way keeps that grant.
+	members := map[string]bool{user.Username: true}
+	found := false
+	var keep []Grant
+	for _, grant := range user.verifiedGrants(shrecord) {
+		if grant.Grantee == username {
+			found = true
+			continue
+		}
+		if !members[grant.Grantor] {
+			continue
+		}
+		if grant.Mode == ReadWrite {
+			members[grant.Grantee] = true
+		}
+		keep = append(keep, grant)
+	}
+	if !found {
+		return &NotFoundError{What: "collaborator", Name: username}
+	}
 
-	// In place AES decryption of ciphertext
-	cipher.XORKeyStream(shrCipher[BlockSize:], shrCipher[BlockSize:])
+	return user.rekey("RevokeUser", fileKey, file, shrecord, keep)
+}
 
-	var shrecord SharingRecord_r
-	err = json.Unmarshal(shrCipher[BlockSize:], &shrecord)
+// Returns the verified sharing tree of a file: who shared it with whom
+// and when, in the order the shares were made.  The owner is the root
+// of the tree.  Revoked shares are not listed.
+func (user *User) ListCollaborators(filename string) ([]Collaborator, error) {
+	_, file, err := user.lookup(filename)
 	if err != nil {
-		return "", errors.New("SharingRecord_r Unmarshalling failed")
+		return nil, err
 	}
-
-	// Verify the integrity of SharingRecord structure
-	shrMarsh, err := json.Marshal(shrecord.SharingRecord)
+	shrecord, err := user.loadSharingRecord(file)
 	if err != nil {
-		return "", errors.New("SharingRecord_r.SharingRecord Marshalling failed")
+		return nil, err
+	}
+
+	var tree []Collaborator
+	for _, grant := range user.verifiedGrants(shrecord) {
+		tree = append(tree, Collaborator{
+			Grantor: grant.Grantor,
+			Grantee: grant.Grantee,
+			Mode:    grant.Mode,
+			Time:    grant.Time,
+		})
 	}
-	mac := userlib.NewHMAC(file.Inode.SymmKey)
-	mac.Write(shrMarsh)
-	if !userlib.Equal(shrecord.Signature, mac.Sum(nil)) {
-		return "", errors.New("SharingRecord Integrity check failed")
+	return tree, nil
+}
+
+// Main Part of the revocations: change the encryption key of the
+// SharingRecord structure (and also its address) and of every data
+// block, and replace the write capability.  Then point the access
+// nodes of the grants in keep at the new record.  Every other access
+// node is deleted along with the old values.
+func (user *User) rekey(op string, fileKey string, file *Inode,
+	shrecord *SharingRecord, keep []Grant) error {
+	garbage, err := user.rekeyRecord(op, fileKey, file, shrecord, keep)
+	if err != nil {
+		return err
 	}
 
-	// Loop through all data blocks, run the checks on them
-	///////////////////////////////////////
-	//           DATA STRUCTURE          //
-	///////////////////////////////////////
-	numBlocks := len(shrecord.SharingRecord.SymmKey)
-	for i := 0; i < numBlocks; i += 1 {
-		dbKey := shrecord.SharingRecord.Address[i]
-		symmKey := shrecord.SharingRecord.SymmKey[i]
-
-		ciphertext, status := userlib.DatastoreGet(dbKey)
-		if status != true {
-			return "", errors.New("Data block not found")
-		}
+	// Delete previous values
+	return user.deleteGarbage(op, garbage)
+}
 
-		iv := ciphertext[:BlockSize]
-		cipher := userlib.CFBDecrypter(symmKey, iv)
+// Does the work of rekey, returning the old values to delete.  A
+// directory gets new blocks listing its entries at new addresses, see
+// rekeyEntries.
+func (user *User) rekeyRecord(op string, fileKey string, file *Inode,
+	shrecord *SharingRecord, keep []Grant) (garbage []string, err error) {
+	old := *file
+	newAddr := newAddress()
+	prevAddr := file.ShRecordAddr
+	writePub, writeKey, err := userlib.GenerateSignKey()
+	if err != nil {
+		return nil, errors.New("Write key generation failed")
+	}
 
-		// In place AES decryption of ciphertext
-		cipher.XORKeyStream(ciphertext[BlockSize:],
-			ciphertext[BlockSize:])
+	// Update the keys and address value in Inode struct
+	file.SymmKey = newSymmKey()
+	file.ShRecordAddr = newAddr
+	file.WriteKey = writeKey
+	shrecord.WritePub = writePub
 
-		var data Data
-		err = json.Unmarshal(ciphertext[BlockSize:], &data)
+	// Update the addresses of every data block
+	garbage = append(garbage, shrecord.Address...)
+	var written []string
+	if file.Dir {
+		// A directory's blocks list the old entries, so they are
+		// written anew instead
+		data, moved, entries, err := user.rekeyEntries(op, &old, file,
+			shrecord)
+		written = moved
 		if err != nil {
-			return "", errors.New("Data block Unmarshalling failed")
+			return nil, &WriteError{Op: op, Leftover: written, Err: err}
 		}
+		garbage = append(garbage, entries...)
 
-		// Check the data integrity
-		mac := userlib.NewHMAC(symmKey)
-		mac.Write(data.Value)
-		hmacSum := mac.Sum(nil)
-		if !userlib.Equal(data.Signature, hmacSum) {
-			return "", errors.New("Data Integrity check failed")
+		blocks := blockList{fileID: shrecord.FileID}
+		if err = user.storeChunks(op, &blocks, data); err != nil {
+			return nil, &WriteError{Op: op, Leftover: written, Err: err}
 		}
+		written = append(written, blocks.address...)
+		shrecord.Address, shrecord.SymmKey = nil, nil
+		shrecord.Hashes, shrecord.Lengths = nil, nil
+		blocks.appendTo(shrecord)
+	} else {
+		for i := range shrecord.Address {
+			// Bring in the blocks, verify their integrity, and place
+			// them somewhere else in the DataStore
+			block, err := user.loadBlock(shrecord, i)
+			if err != nil {
+				return nil, err
+			}
+
+			// New address and key for the block
+			address, dbkey := newAddress(), newSymmKey()
 
-		// Key-value swap check
-		if dbKey != data.KeyAddr {
-			return "", errors.New("Key Value swap detected")
+			hash, err := user.storeData(address, dbkey, block)
+			if err != nil {
+				return nil, &WriteError{Op: op, Leftover: written, Err: err}
+			}
+			written = append(written, address)
+			shrecord.Address[i] = address
+			shrecord.SymmKey[i] = dbkey
+			shrecord.Hashes[i] = hash
 		}
 	}
 
-	//
-	// Find collected_info and return after appropriate verification
-	collected_info := struct {
-		SymmKey      []byte
-		ShRecordAddr string
-	}{
-		file.Inode.SymmKey,
-		file.Inode.ShRecordAddr,
+	// Only the nodes we can still open survive; the nodes of the other
+	// verified grants are garbage
+	oldGrants := user.verifiedGrants(shrecord)
+	kept := make(map[string]bool)
+	var keys [][]byte
+	shrecord.Grants = nil
+	for _, grant := range keep {
+		key, err := userlib.RSADecrypt(user.Privkey, grant.WrappedKey,
+			[]byte("Tag"))
+		if err != nil || len(key) != userlib.AESKeySize {
+			continue
+		}
+		shrecord.Grants = append(shrecord.Grants, grant)
+		keys = append(keys, key)
+		kept[grant.AccessAddr] = true
 	}
 
-	recvPubKey, status := userlib.KeystoreGet(recipient)
-	if !status {
-		return "", errors.New("Recipient not found")
+	// The ownership claim covers the address and the write capability,
+	// so sign the new ones
+	err = user.signOwnership(file, shrecord)
+	if err != nil {
+		return nil, &WriteError{Op: op, Leftover: written, Err: err}
 	}
 
-	// Store the signature and encoding of collected_info
-	infoMarsh, err := json.Marshal(collected_info)
+	// Push the re-encrypted SharingRecord and the updated Inode, which
+	// is the commit point
+	err = user.storeSharingRecord(file, shrecord)
 	if err != nil {
-		return "", errors.New("Collected Info Marshalling failed")
+		return nil, &WriteError{Op: op, Leftover: written, Err: err}
 	}
-
-	infoSign, err := userlib.RSASign(user.Privkey, infoMarsh)
+	written = append(written, newAddr)
+	err = user.storeInode(fileKey, file)
 	if err != nil {
-		return "", errors.New("RSA Signing of Collected_info failed")
+		return nil, &WriteError{Op: op, Leftover: written, Err: err}
 	}
 
-	// Finally, encrypt the whole Packet struct with reciever's Public key
-	send_info := struct {
-		Collected_info []byte
-		Signature      []byte
-	}{
-		infoMarsh,
-		infoSign,
+	// Re-point the remaining collaborators.  Until this is done the
+	// old values must stay, since some of them still read them.
+	garbage = append(garbage, prevAddr)
+	for i, grant := range shrecord.Grants {
+		err = storeSealed(user.datastore(), grant.AccessAddr, keys[i],
+			newAccessNode(file, grant.Mode))
+		if err != nil {
+			return nil, &WriteError{Op: op, Committed: true,
+				Leftover: garbage, Err: err}
+		}
+	}
+	for _, grant := range oldGrants {
+		if !kept[grant.AccessAddr] {
+			garbage = append(garbage, grant.AccessAddr)
+		}
 	}
+	return garbage, nil
+}
+
+///////////////////////////////////////
+//              HELPERS              //
+///////////////////////////////////////
 
-	mgsidMarsh, err := json.Marshal(send_info)
+// A msgid is hybrid encrypted: a fresh message key is RSA encrypted to
+// the recipient and seals the signed payload
+type msgEnvelope struct {
+	WrappedKey []byte
+	Sealed     []byte
+}
+
+type sharingMessage struct {
+	Collected_info []byte
+	Signature      []byte
+}
+
+// Signs info (as JSON) with priv and seals it so that only the owner
+// of pub can open it.  Returns the hex encoded msgid.
+func sealMessage(priv *userlib.PrivateKey, pub *userlib.PublicKey,
+	info interface{}) (msgid string, err error) {
+	infoMarsh, err := json.Marshal(info)
 	if err != nil {
-		return "", errors.New("msgid Marshalling failed")
+		return "", errors.New("Collected Info Marshalling failed")
 	}
 
-	// To store encrypted chunks
-	var sharing [][]byte
-	var encryptedBlock []byte
-	index = 0
-
-	for index+190 <= len(mgsidMarsh) {
-		// RSA Asymmetric Key Encryption
-		encryptedBlock, err = userlib.RSAEncrypt(&recvPubKey,
-			mgsidMarsh[index:index+190], []byte("Tag"))
-		if err != nil {
-			return "", errors.New("RSA Encryption of 'sharing' failed\n")
-		}
-		index += 190
-		sharing = append(sharing, encryptedBlock)
+	infoSign, err := userlib.RSASign(priv, infoMarsh)
+	if err != nil {
+		return "", errors.New("RSA Signing of Collected_info failed")
 	}
 
-	// In case the final chunk is not a multiple of 190
-	encryptedBlock, err = userlib.RSAEncrypt(&recvPubKey,
-		mgsidMarsh[index:], []byte("Tag"))
+	msgMarsh, err := json.Marshal(sharingMessage{
+		Collected_info: infoMarsh,
+		Signature:      infoSign,
+	})
 	if err != nil {
-		return "", errors.New("RSA Encryption of 'sharing' failed\n")
+		return "", errors.New("msgid Marshalling failed")
 	}
-	sharing = append(sharing, encryptedBlock)
 
-	sharingMarsh, err := json.Marshal(sharing)
+	// RSA is only used to transport the message key
+	msgKey := newSymmKey()
+	wrapped, err := userlib.RSAEncrypt(pub, msgKey, []byte("Tag"))
 	if err != nil {
-		return "", errors.New("Marshalling of sharing structure failed")
+		return "", fmt.Errorf("RSA Encryption failed: %v", err)
 	}
 
-	return hex.EncodeToString(sharingMarsh), nil
+	envelope, err := json.Marshal(msgEnvelope{
+		WrappedKey: wrapped,
+		Sealed:     userlib.AEADSeal(msgKey, msgMarsh, wrapped),
+	})
+	if err != nil {
+		return "", errors.New("msgid Marshalling failed")
+	}
 
+	return hex.EncodeToString(envelope), nil
 }
 
-// Note recipient's filename can be different from the sender's filename.
-// The recipient should not be able to discover the sender's view on
-// what the filename even is!  However, the recipient must ensure that
-// it is authentically from the sender.
-func (user *User) ReceiveFile(filename string, sender string,
-	msgid string) error {
-
-	sharingMarsh, err := hex.DecodeString(msgid)
+// Opens a msgid produced by sealMessage with priv and checks that it
+// was signed by the owner of senderPub before unmarshalling it into
+// info.
+func openMessage(priv *userlib.PrivateKey, senderPub *userlib.PublicKey,
+	msgid string, info interface{}) error {
+	envMarsh, err := hex.DecodeString(msgid)
 	if err != nil {
-		return errors.New("Msgid corrupted")
+		return integrityError(StructMsgid, "not hex encoded")
 	}
 
-	var sharing [][]byte
-	err = json.Unmarshal(sharingMarsh, &sharing)
+	var envelope msgEnvelope
+	err = json.Unmarshal(envMarsh, &envelope)
 	if err != nil {
-		return errors.New("'sharing' Unmarshalling failed")
+		return integrityError(StructMsgid, "unmarshalling failed")
 	}
 
-	// Retrieve sender's public key
-	sendPubKey, status := userlib.KeystoreGet(sender)
-	if !status {
-		return errors.New("Sender not found")
+	msgKey, err := userlib.RSADecrypt(priv, envelope.WrappedKey, []byte("Tag"))
+	if err != nil || len(msgKey) != userlib.AESKeySize {
+		return integrityError(StructMsgid, "decryption failed")
 	}
-
-	// Retreive the Marshalled messaged struct from the encrypted chunks
-	index := 0
-	msgidMarsh := make([]byte, len(sharing))
-	for index < len(sharing) {
-		// RSA Asymmetric Key Decryption
-		decryptedBlock, err := userlib.RSADecrypt(user.Privkey,
-			sharing[index], []byte("Tag"))
-		if err != nil {
-			return errors.New("RSA Encryption of 'sharing' failed\n")
-		}
-
-		msgidMarsh = append(msgidMarsh, decryptedBlock...)
-		index += 1
-	}
-
-	// Remove leading \x00 characters from inodeMarsh
-	for msgidMarsh[0] == []byte("\x00")[0] {
-		msgidMarsh = remove(msgidMarsh, 0)
+	msgMarsh, err := userlib.AEADOpen(msgKey, envelope.Sealed,
+		envelope.WrappedKey)
+	if err != nil {
+		return integrityError(StructMsgid, "authentication failed")
 	}
 
-	recv_info := struct {
-		Collected_info []byte
-		Signature      []byte
-	}{}
-	err = json.Unmarshal(msgidMarsh, &recv_info)
+	var recv_info sharingMessage
+	err = json.Unmarshal(msgMarsh, &recv_info)
 	if err != nil {
-		return errors.New("Received Info Unmarshalling failed")
+		return integrityError(StructMsgid, "unmarshalling failed")
 	}
 
 	// Verify the Integrity of "sharing" message
-	err = userlib.RSAVerify(&sendPubKey, recv_info.Collected_info,
+	err = userlib.RSAVerify(senderPub, recv_info.Collected_info,
 		recv_info.Signature)
 	if err != nil {
-		return errors.New("Msgid has been tampered")
+		return integrityError(StructMsgid, "bad signature")
 	}
 
-	collected_info := struct {
-		SymmKey      []byte
-		ShRecordAddr string
-	}{}
-	err = json.Unmarshal(recv_info.Collected_info, &collected_info)
+	err = json.Unmarshal(recv_info.Collected_info, info)
 	if err != nil {
-		return errors.New("Recieved Info Unmarshalling failed")
-	}
-
-	///////////////////////////////////////
-	//           INODE STRUCTURE         //
-	///////////////////////////////////////
-	fileKey := user.GetInodeKey(filename)
-
-	//
-	// Initialize the Inode structure without any signature (at the moment)
-	//
-
-	// Generate a random Initialization Vector and random address for
-	// encryption of SharingRecord Structure
-	iv := make([]byte, BlockSize)
-	copy(iv, userlib.RandomBytes(BlockSize))
-
-	//
-	// Here, after verifying the integrity of SharingRecord structure,
-	// We add the recieved info about its address and symmetric keys
-	// in the new inode
-	randbyte := collected_info.SymmKey
-	address := collected_info.ShRecordAddr
-
-	file := &Inode_r{
-		KeyAddr: fileKey, // The key at which this struct will be stored
-		Inode: Inode{
-			Filename:     filename,
-			ShRecordAddr: address,
-			SymmKey:      randbyte[:16],
-		},
+		return integrityError(StructMsgid, "unmarshalling failed")
 	}
+	return nil
+}
 
-	// Store the signature of Inode_r.Inode in Inode_r.Signature
-	fileMarsh, err := json.Marshal(file.Inode)
+// Retrieves and opens the caller's Inode for the file at filename, see
+// lookup.  Directories are refused.
+func (user *User) loadInode(filename string) (fileKey string,
+	file *Inode, err error) {
+	fileKey, file, err = user.lookup(filename)
 	if err != nil {
-		return errors.New("Inode_r.Inode Marshalling failed")
+		return "", nil, err
+	}
+	if file.Dir {
+		return "", nil, fmt.Errorf("%q: %w", filename, ErrIsDir)
 	}
+	return fileKey, file, nil
+}
 
-	file.Signature, err = userlib.RSASign(user.Privkey, fileMarsh)
+// Retrieves and opens the Inode at address, sealed under key and bound
+// to the address, for the file at path in the directory parent (nil
+// for a top-level name).  Its writeSecrets are only opened when we can
+// write to parent, and a share in a directory only opens for the user
+// who received it.
+func (user *User) openInode(address string, key []byte, path string,
+	parent *Inode) (*Inode, error) {
+	file, err := user.readInode(address, key, path, parent)
 	if err != nil {
-		return errors.New("RSA Signing of Inode_r.Inode failed")
+		return nil, err
+	}
+	if file.AccessAddr != "" && file.AccessKey == nil {
+		return nil, &PermissionError{Op: "open", Name: path,
+			Reason: "received by " + file.Receiver}
+	}
+	recordKey := file.SymmKey
+	if file.AccessAddr != "" {
+		recordKey = file.AccessKey
 	}
+	if len(recordKey) != userlib.AESKeySize {
+		return nil, integrityError(StructInode, "bad key")
+	}
+	return file, nil
+}
 
-	// Finally, encrypt the whole Inode_r struct with User's Public key
-	inodeMarsh, err := json.Marshal(file)
-	if err != nil {
-		return errors.New("Inode_r Marshalling failed")
+// Does the work of openInode, but leaves out of a share whatever we
+// can't open instead of refusing it
+func (user *User) readInode(address string, key []byte, path string,
+	parent *Inode) (*Inode, error) {
+	file := &Inode{}
+	status, err := loadSealed(user.datastore(), address, key, file)
+	if !status && err != nil {
+		return nil, err
+	} else if !status {
+		return nil, &NotFoundError{What: "file", Name: path}
+	}
+	if err != nil {
+		return nil, integrityError(StructInode, err.Error())
+	}
+	if parent != nil {
+		file.WriteKey, file.AccessKey = nil, nil
+		if parent.WriteKey != nil && file.Sealed != nil {
+			var secrets writeSecrets
+			err = openSealed(address, dirSecret(parent), file.Sealed,
+				&secrets)
+			if err != nil {
+				return nil, integrityError(StructInode, "sealed keys: "+
+					err.Error())
+			}
+			file.WriteKey = secrets.WriteKey
+		}
+		if file.AccessAddr != "" && file.Receiver == user.Username {
+			err = openSealed(file.AccessAddr, user.receivedSecret(),
+				file.Received, &file.AccessKey)
+			if err != nil {
+				return nil, integrityError(StructInode, "received key: "+
+					err.Error())
+			}
+		}
 	}
 
-	// To store encrypted chunks
-	var encrypted [][]byte
-	var encryptedBlock []byte
-	index = 0
+	file.Filename, file.key, file.parent = path, key, parent
+	return file, nil
+}
 
-	for index+190 <= len(inodeMarsh) {
-		// RSA Asymmetric Key Encryption
-		encryptedBlock, err = userlib.RSAEncrypt(&user.Privkey.PublicKey,
-			inodeMarsh[index:index+190], []byte("Tag"))
+// Seals the Inode under its key and pushes it to fileKey.  For files
+// shared with us only the access node is stored, never what
+// loadSharingRecord resolved from it.  Inside a directory the
+// writeSecrets are sealed separately, which takes the directory's
+// write capability, and so is the AccessKey of a share, for its
+// receiver only.  A share we couldn't open keeps what its receiver
+// sealed.
+func (user *User) storeInode(fileKey string, file *Inode) error {
+	stored := *file
+	stored.Sealed, stored.Received = nil, nil
+	if file.AccessAddr != "" {
+		stored.ShRecordAddr, stored.SymmKey = "", nil
+		stored.WriteKey = nil
+	}
+	if file.parent != nil {
+		if file.parent.WriteKey == nil {
+			return &PermissionError{Op: "write", Name: file.Filename,
+				Reason: "read-only directory"}
+		}
+		sealed, err := seal(fileKey, dirSecret(file.parent), writeSecrets{
+			WriteKey: stored.WriteKey,
+		})
 		if err != nil {
-			return errors.New("RSA Encryption of Inode_r failed\n")
+			return err
+		}
+		stored.Sealed = sealed
+		stored.Received = file.Received
+		if file.AccessAddr != "" && file.AccessKey != nil {
+			stored.Received, err = seal(file.AccessAddr,
+				user.receivedSecret(), file.AccessKey)
+			if err != nil {
+				return err
+			}
 		}
-		index += 190
-		encrypted = append(encrypted, encryptedBlock)
+		stored.WriteKey, stored.AccessKey = nil, nil
 	}
+	return storeSealed(user.datastore(), fileKey, file.key, &stored)
+}
+
+// Returns a fresh random DataStore address
+func newAddress() string {
+	return hex.EncodeToString(userlib.RandomBytes(16))
+}
 
-	// In case the final chunk is not a multiple of 190
-	encryptedBlock, err = userlib.RSAEncrypt(&user.Privkey.PublicKey,
-		inodeMarsh[index:], []byte("Tag"))
+// Returns a fresh random symmetric key
+func newSymmKey() []byte {
+	return userlib.RandomBytes(userlib.AESKeySize)
+}
+
+// Seals v (as JSON) with AES-GCM under key, using address as the
+// associated data, and pushes it to address.  Moving the ciphertext
+// anywhere else makes it fail to open.
+func storeSealed(ds userlib.Datastore, address string, key []byte,
+	v interface{}) error {
+	sealed, err := seal(address, key, v)
 	if err != nil {
-		return errors.New("RSA Encryption of Inode_r failed\n")
+		return err
 	}
-	encrypted = append(encrypted, encryptedBlock)
+	return ds.Set(address, sealed)
+}
 
-	encryptedMarsh, err := json.Marshal(encrypted)
+// Seals v (as JSON) for address, see storeSealed
+func seal(address string, key []byte, v interface{}) ([]byte, error) {
+	marsh, err := json.Marshal(v)
 	if err != nil {
-		return errors.New("Marshalling of encrypted blocks failed")
+		return nil, err
 	}
+	return userlib.AEADSeal(key, marsh, []byte(address)), nil
+}
 
-	// userlib.DatastoreDelete(fileKey)
-	_, status = userlib.DatastoreGet(fileKey)
-	if status {
-		return errors.New("The specified file already exists")
+// Opens what seal sealed for address into v
+func openSealed(address string, key []byte, ciphertext []byte,
+	v interface{}) error {
+	marsh, err := userlib.AEADOpen(key, ciphertext, []byte(address))
+	if err != nil {
+		return errors.New("authentication failed")
+	}
+	if err = json.Unmarshal(marsh, v); err != nil {
+		return errors.New("unmarshalling failed")
 	}
-
-	userlib.DatastoreSet(fileKey, encryptedMarsh)
-
 	return nil
 }
 
-// Removes access for all others.
-func (user *User) RevokeFile(filename string) (err error) {
-	///////////////////////////////////////
-	//           INODE STRUCTURE         //
-	///////////////////////////////////////
-	fileKey := user.GetInodeKey(filename)
-
-	// Retrieve the encrypted Inode structure from DataStore
-	rsaEncrypted, status := userlib.DatastoreGet(fileKey)
-	if status != true {
-		return errors.New("Filename not found")
-	}
-
-	var encrypted [][]byte
-	err = json.Unmarshal(rsaEncrypted, &encrypted)
-	if err != nil {
-		return errors.New("Inode_r Unmarshalling failed")
+// Retrieves the value at address and opens it into v.  status is false
+// when nothing is stored there, or when the Datastore failed to look,
+// which err then reports.  Otherwise err reports a value that doesn't
+// open.
+func loadSealed(ds userlib.Datastore, address string, key []byte,
+	v interface{}) (status bool, err error) {
+	ciphertext, status, err := userlib.GetChecked(ds, address)
+	if !status {
+		return false, err
 	}
+	return true, openSealed(address, key, ciphertext, v)
+}
 
-	// Retreive the Marshalled Inode_r struct from the encrypted chunks
-	index := 0
-	inodeMarsh := make([]byte, len(encrypted))
-	for index < len(encrypted) {
-		// RSA Asymmetric Key Decryption
-		decryptedBlock, err := userlib.RSADecrypt(user.Privkey,
-			encrypted[index], []byte("Tag"))
+// Retrieves and opens the SharingRecord an Inode points to.  For files
+// shared with us this first follows the access node and fills in the
+// Inode's ShRecordAddr and SymmKey.
+func (user *User) loadSharingRecord(file *Inode) (*SharingRecord, error) {
+	if file.AccessAddr != "" {
+		// Our access node is gone when we were revoked
+		var node accessNode
+		status, err := loadSealed(user.datastore(), file.AccessAddr,
+			file.AccessKey, &node)
+		if !status && err != nil {
+			return nil, err
+		} else if !status {
+			return nil, &NotFoundError{What: "sharing record", Name: file.Filename}
+		}
 		if err != nil {
-			return errors.New("RSA Encryption of Inode_r failed\n")
+			return nil, integrityError(StructInode, "access node: "+err.Error())
 		}
+		file.ShRecordAddr, file.SymmKey = node.ShRecordAddr, node.SymmKey
+		file.WriteKey = node.WriteKey
+	}
 
-		inodeMarsh = append(inodeMarsh, decryptedBlock...)
-		index += 1
+	// It is gone when the file was revoked
+	var shrecord SharingRecord
+	status, err := loadSealed(user.datastore(), file.ShRecordAddr,
+		file.SymmKey, &shrecord)
+	if !status && err != nil {
+		return nil, err
+	} else if !status {
+		return nil, &NotFoundError{What: "sharing record", Name: file.Filename}
+	}
+	if err != nil {
+		return nil, integrityError(StructSharingRecord, err.Error())
 	}
 
-	// Remove leading \x00 characters from inodeMarsh
-	for inodeMarsh[0] == []byte("\x00")[0] {
-		inodeMarsh = remove(inodeMarsh, 0)
+	if (shrecord.Type == dirRecord) != file.Dir {
+		return nil, integrityError(StructSharingRecord, "type changed")
+	}
+	if len(shrecord.Address) != len(shrecord.SymmKey) ||
+		len(shrecord.Address) != len(shrecord.Hashes) ||
+		len(shrecord.Address) != len(shrecord.Lengths) {
+		return nil, integrityError(StructSharingRecord, "block list mismatch")
 	}
 
-	var file Inode_r
-	err = json.Unmarshal(inodeMarsh, &file)
+	// Anybody holding the record's key can rewrite it, but only the
+	// owner can sign the ownership claim for this address
+	if shrecord.MainAuthor != file.Owner {
+		return nil, integrityError(StructSharingRecord, "owner changed")
+	}
+	ownerPubKey, status := user.keystore().Get(shrecord.MainAuthor)
+	if !status {
+		return nil, integrityError(StructSharingRecord, "unknown owner")
+	}
+	claim, err := json.Marshal(ownershipClaim{
+		Owner:        shrecord.MainAuthor,
+		ShRecordAddr: file.ShRecordAddr,
+		FileID:       shrecord.FileID,
+		WritePub:     shrecord.WritePub,
+	})
 	if err != nil {
-		return errors.New("Inode_r Unmarshalling failed")
+		return nil, errors.New("Ownership claim Marshalling failed")
 	}
-
-	// Verify Inode structure's integrity
-	fileMarsh, err := json.Marshal(file.Inode)
+	err = userlib.RSAVerify(&ownerPubKey, claim, shrecord.OwnerSig)
 	if err != nil {
-		return errors.New("Inode_r.Inode Marshalling failed")
+		return nil, integrityError(StructSharingRecord, "bad owner signature")
 	}
 
-	err = userlib.RSAVerify(&user.Privkey.PublicKey, fileMarsh, file.Signature)
+	// Everything else must come from a holder of the write capability
+	claim, err = writeClaimFor(file, &shrecord)
+	if err != nil {
+		return nil, err
+	}
+	err = userlib.Verify(shrecord.WritePub, claim, shrecord.WriteSig)
 	if err != nil {
-		return errors.New("Inode Integrity Check failed")
+		return nil, integrityError(StructSharingRecord, "bad write signature")
 	}
 
-	//
-	///////////////////////////////////////
-	//      SHARINGRECORD STRUCTURE      //
-	///////////////////////////////////////
-	// Retrieve encrypted SharingRecord structure from DataStore
-	shrCipher, status := userlib.DatastoreGet(file.Inode.ShRecordAddr)
-	if !status {
-		return errors.New("Sharing Record Structure can't be found")
+	// Finally make sure it is no older than what we saw before
+	shrecord.hash = hashBytes(claim)
+	if err = user.checkFreshness(file.Filename, &shrecord); err != nil {
+		return nil, err
 	}
+	user.see(&shrecord)
 
-	iv := shrCipher[:BlockSize]
-	cipher := userlib.CFBDecrypter(file.Inode.SymmKey, iv)
+	return &shrecord, nil
+}
 
-	// In place AES decryption of ciphertext
-	cipher.XORKeyStream(shrCipher[BlockSize:], shrCipher[BlockSize:])
+// Signs the ownership claim of a SharingRecord stored at the address
+// the Inode points to
+func (user *User) signOwnership(file *Inode, shrecord *SharingRecord) (err error) {
+	claim, err := json.Marshal(ownershipClaim{
+		Owner:        shrecord.MainAuthor,
+		ShRecordAddr: file.ShRecordAddr,
+		FileID:       shrecord.FileID,
+		WritePub:     shrecord.WritePub,
+	})
+	if err != nil {
+		return errors.New("Ownership claim Marshalling failed")
+	}
+	shrecord.OwnerSig, err = userlib.RSASign(user.Privkey, claim)
+	if err != nil {
+		return errors.New("RSA Signing of ownership claim failed")
+	}
+	return nil
+}
 
-	var shrecord SharingRecord_r
-	err = json.Unmarshal(shrCipher[BlockSize:], &shrecord)
+// Records a share of the file with grantee through the access node at
+// accessAddr.  The node key is wrapped for the owner and the grant is
+// signed by us.
+func (user *User) newGrant(shrecord *SharingRecord, grantee string,
+	mode Mode, accessAddr string, accessKey []byte) (*Grant, error) {
+	ownerPubKey, status := user.keystore().Get(shrecord.MainAuthor)
+	if !status {
+		return nil, integrityError(StructSharingRecord, "unknown owner")
+	}
+	wrapped, err := userlib.RSAEncrypt(&ownerPubKey, accessKey, []byte("Tag"))
 	if err != nil {
-		return errors.New("SharingRecord_r Unmarshalling failed")
+		return nil, fmt.Errorf("RSA Encryption failed: %v", err)
 	}
 
-	// Verify the integrity of SharingRecord structure
-	shrMarsh, err := json.Marshal(shrecord.SharingRecord)
+	grant := &Grant{
+		Grantor:    user.Username,
+		Grantee:    grantee,
+		AccessAddr: accessAddr,
+		WrappedKey: wrapped,
+		Mode:       mode,
+		Time:       time.Now().UTC(),
+	}
+	claim, err := grant.claim()
 	if err != nil {
-		return errors.New("SharingRecord_r.SharingRecord Marshalling failed")
+		return nil, errors.New("Grant claim Marshalling failed")
 	}
-	mac := userlib.NewHMAC(file.Inode.SymmKey)
-	mac.Write(shrMarsh)
-	if !userlib.Equal(shrecord.Signature, mac.Sum(nil)) {
-		return errors.New("SharingRecord Integrity check failed")
+	grant.Signature, err = userlib.RSASign(user.Privkey, claim)
+	if err != nil {
+		return nil, errors.New("RSA Signing of grant failed")
 	}
+	return grant, nil
+}
 
-	//
-	// Main Part of RevokeFile, change the encryption key of SharingRecord
-	// structure (and also it's address)
+// Returns the grants that form the sharing tree: each must be signed by
+// its grantor, who must be the owner or the grantee of an earlier
+// read-write grant.  Anything else was made up by whoever rewrote the
+// record and is skipped.
+func (user *User) verifiedGrants(shrecord *SharingRecord) []Grant {
+	members := map[string]bool{shrecord.MainAuthor: true}
+	var tree []Grant
+	for _, grant := range shrecord.Grants {
+		if !members[grant.Grantor] {
+			continue
+		}
+		pubKey, status := user.keystore().Get(grant.Grantor)
+		if !status {
+			continue
+		}
+		claim, err := grant.claim()
+		if err != nil {
+			continue
+		}
+		if userlib.RSAVerify(&pubKey, claim, grant.Signature) != nil {
+			continue
+		}
+		if grant.Mode == ReadWrite {
+			members[grant.Grantee] = true
+		}
+		tree = append(tree, grant)
+	}
+	return tree
+}
 
-	newKey, err := json.Marshal(userlib.RandomBytes(BlockSize))
-	newAddr := hex.EncodeToString(newKey[:16])
+// Returns what the write capability signs for a SharingRecord stored
+// at the address the Inode points to
+func writeClaimFor(file *Inode, shrecord *SharingRecord) ([]byte, error) {
+	record := *shrecord
+	record.WriteSig = nil
+	claim, err := json.Marshal(writeClaim{
+		ShRecordAddr: file.ShRecordAddr,
+		Record:       record,
+	})
 	if err != nil {
-		return errors.New("New-key marshalling failed")
+		return nil, errors.New("Write claim Marshalling failed")
 	}
+	return claim, nil
+}
 
-	prevAddr := file.Inode.ShRecordAddr
-
-	// Update the key and address value in Inode struct
-	file.Inode.SymmKey = newKey[:16]
-	file.Inode.ShRecordAddr = newAddr
+// Makes the SharingRecord the next version of the one loaded, signs it
+// with the write capability, seals it and pushes it to the address the
+// Inode points to
+func (user *User) storeSharingRecord(file *Inode,
+	shrecord *SharingRecord) (err error) {
+	if file.WriteKey == nil {
+		return &PermissionError{Op: "write", Name: file.Filename,
+			Reason: "read-only share"}
+	}
+	shrecord.Version++
+	shrecord.PrevHash = shrecord.hash
 
-	// IMP
-	// Need to store the updated addresses of Inode
-	// Store the signature of Inode_r.Inode in Inode_r.Signature
-	fileMarsh1, err := json.Marshal(file.Inode)
+	claim, err := writeClaimFor(file, shrecord)
 	if err != nil {
-		return errors.New("File Inode marshalling failed")
+		return err
 	}
-
-	file.Signature, err = userlib.RSASign(user.Privkey, fileMarsh1)
+	shrecord.WriteSig, err = userlib.Sign(file.WriteKey, claim)
 	if err != nil {
-		return errors.New("File signing unsuccessful")
+		return errors.New("Signing with the write key failed")
 	}
-
-	// Finally, encrypt the whole Inode_r struct with User's Public key
-	inodeMarsh1, err := json.Marshal(file)
+	err = storeSealed(user.datastore(), file.ShRecordAddr, file.SymmKey,
+		shrecord)
 	if err != nil {
-		return errors.New("Inode_r marshalling failed")
+		return err
 	}
+	shrecord.hash = hashBytes(claim)
+	user.see(shrecord)
+	return nil
+}
 
-	// To store encrypted chunks
-	var encrypted1 [][]byte
-	var encryptedBlock1 []byte
-	index = 0
-
-	for index+190 <= len(inodeMarsh1) {
-		// RSA Asymmetric Key Encryption
-		encryptedBlock1, err = userlib.RSAEncrypt(&user.Privkey.PublicKey,
-			inodeMarsh1[index:index+190], []byte("Tag"))
-		if err != nil {
-			return
-		}
-		index += 190
-		encrypted1 = append(encrypted1, encryptedBlock1)
+// Checks a SharingRecord against the newest version of the file we saw
+// before.  A newer version right after it must chain to it; later
+// versions can only be checked to be newer.  The filename is only for
+// the error.
+func (user *User) checkFreshness(filename string,
+	shrecord *SharingRecord) error {
+	seen, ok := user.Seen[shrecord.FileID]
+	if !ok {
+		return nil
+	}
+	switch {
+	case shrecord.Version < seen.Version:
+		return &FreshnessError{Name: filename, Seen: seen.Version,
+			Got: shrecord.Version}
+	case shrecord.Version == seen.Version &&
+		!userlib.Equal(shrecord.hash, seen.Hash),
+		shrecord.Version == seen.Version+1 &&
+			!userlib.Equal(shrecord.PrevHash, seen.Hash):
+		return &FreshnessError{Name: filename, Seen: seen.Version,
+			Got: shrecord.Version, Fork: true}
 	}
+	return nil
+}
 
-	// In case the final chunk is not a multiple of 190
-	encryptedBlock1, err = userlib.RSAEncrypt(&user.Privkey.PublicKey,
-		inodeMarsh1[index:], []byte("Tag"))
-	if err != nil {
+// Remembers a verified SharingRecord as the newest version of the file
+func (user *User) see(shrecord *SharingRecord) {
+	if user.Seen == nil {
+		user.Seen = make(map[string]FileVersion)
+	}
+	seen, ok := user.Seen[shrecord.FileID]
+	if ok && seen.Version > shrecord.Version {
 		return
 	}
-	encrypted1 = append(encrypted1, encryptedBlock1)
+	user.Seen[shrecord.FileID] = FileVersion{
+		Version: shrecord.Version,
+		Hash:    shrecord.hash,
+	}
+}
 
-	encryptedMarsh1, err := json.Marshal(encrypted1)
-	if err != nil {
-		return
+// The access node given out for a share of the file in mode
+func newAccessNode(file *Inode, mode Mode) *accessNode {
+	node := &accessNode{ShRecordAddr: file.ShRecordAddr, SymmKey: file.SymmKey}
+	if mode == ReadWrite {
+		node.WriteKey = file.WriteKey
 	}
+	return node
+}
 
-	// Update the addresses of every data block
-	numBlocks := len(shrecord.SharingRecord.SymmKey)
-	for i := 0; i < numBlocks; i += 1 {
-		// Bring in the blocks, verify their integrity, and place them
-		// somewhere else in the DataStore
-		dbKey := shrecord.SharingRecord.Address[i] // TODO: Change the loc
-		symmKey := shrecord.SharingRecord.SymmKey[i]
-
-		ciphertext, status := userlib.DatastoreGet(dbKey)
-		if status != true {
-			return errors.New("Data block not found")
-		}
+// The hash a SharingRecord keeps of a sealed block.  Everybody with
+// the record can seal blocks, so this is what ties the blocks to the
+// writer who signed the record.
+func blockHash(sealed []byte) []byte {
+	return hashBytes(sealed)
+}
 
-		iv := ciphertext[:BlockSize]
-		cipher := userlib.CFBDecrypter(symmKey, iv)
+// SHA256 of b
+func hashBytes(b []byte) []byte {
+	h := userlib.NewSHA256()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// Tells a block that a later write deleted from one the server lost.
+// Writers delete the blocks they replace right after committing, so a
+// reader still holding the old SharingRecord can find one missing: if
+// the current record no longer lists it, err becomes ErrConflict.
+func (user *User) blockGone(filename string, shrecord *SharingRecord,
+	err error) error {
+	var integrity *IntegrityError
+	if !errors.As(err, &integrity) || integrity.Reason != "block missing" {
+		return err
+	}
+	_, file, lerr := user.loadInode(filename)
+	if lerr != nil {
+		return err
+	}
+	current, lerr := user.loadSharingRecord(file)
+	if lerr != nil {
+		return err
+	}
+	for _, address := range current.Address {
+		if address == shrecord.Address[integrity.Block] {
+			return err
+		}
+	}
+	return fmt.Errorf("%q changed while reading it: %w", filename,
+		ErrConflict)
+}
 
-		// In place AES decryption of ciphertext
-		cipher.XORKeyStream(ciphertext[BlockSize:],
-			ciphertext[BlockSize:])
+// Retrieves and opens data block i of a SharingRecord
+func (user *User) loadBlock(shrecord *SharingRecord, i int) (*Data, error) {
+	address := shrecord.Address[i]
+	sealed, status, err := userlib.GetChecked(user.datastore(), address)
+	if err != nil {
+		return nil, err
+	} else if !status {
+		return nil, &IntegrityError{StructData, i, "block missing"}
+	}
+	if !userlib.Equal(blockHash(sealed), shrecord.Hashes[i]) {
+		return nil, &IntegrityError{StructData, i, "hash mismatch"}
+	}
+	var data Data
+	err = openSealed(address, shrecord.SymmKey[i], sealed, &data)
+	if err != nil {
+		return nil, &IntegrityError{StructData, i, err.Error()}
+	}
 
-		var data Data
-		err = json.Unmarshal(ciphertext[BlockSize:], &data)
+	if len(data.Merged) > 0 {
+		data.Value = nil
+	} else if data.Skip != 0 || data.Drop != 0 {
+		return nil, &IntegrityError{StructData, i, "trimmed block"}
+	}
+	for _, piece := range data.pieces() {
+		if len(piece.Merged) > 0 {
+			return nil, &IntegrityError{StructData, i, "nested merge"}
+		}
+		if piece.Skip < 0 || piece.Drop < 0 ||
+			piece.Skip+piece.Drop >= len(piece.Value) {
+			return nil, &IntegrityError{StructData, i, "bad trim"}
+		}
+		authorPubKey, status := user.keystore().Get(piece.Author)
+		if !status {
+			return nil, &IntegrityError{StructData, i, "unknown author"}
+		}
+		claim, err := json.Marshal(blockClaim{FileID: shrecord.FileID,
+			Author: piece.Author, Nonce: piece.Nonce, Value: piece.Value})
 		if err != nil {
-			return errors.New("Data block Unmarshalling failed")
+			return nil, errors.New("Block claim Marshalling failed")
 		}
-
-		// Check the data integrity
-		mac := userlib.NewHMAC(symmKey)
-		mac.Write(data.Value)
-		hmacSum := mac.Sum(nil)
-		if !userlib.Equal(data.Signature, hmacSum) {
-			return errors.New("Data Integrity check failed")
+		if userlib.RSAVerify(&authorPubKey, claim, piece.Signature) != nil {
+			return nil, &IntegrityError{StructData, i, "bad author signature"}
 		}
-
-		// Key-value swap check
-		if dbKey != data.KeyAddr {
-			return errors.New("Key Value swap detected")
+		if len(data.Merged) > 0 {
+			data.Value = append(data.Value, piece.content()...)
 		}
+	}
+	if len(data.Value) != shrecord.Lengths[i] {
+		return nil, &IntegrityError{StructData, i, "length mismatch"}
+	}
+	return &data, nil
+}
 
-		// New address for the block
-		randbyte, _ := json.Marshal(userlib.RandomBytes(BlockSize))
-		// randbyte, _ = json.Marshal(randbyte)
-		address := hex.EncodeToString(randbyte[:16])
+// The size of the file, from the block lengths
+func (shrecord *SharingRecord) size() int {
+	return sumLengths(shrecord.Lengths)
+}
 
-		shrecord.SharingRecord.Address[i] = address
-		data.KeyAddr = address
+func sumLengths(lengths []int) int {
+	size := 0
+	for _, n := range lengths {
+		size += n
+	}
+	return size
+}
 
-		//
-		// Re-encrypt the data block
-		dblockMarsh, err := json.Marshal(data)
-		if err != nil {
-			return errors.New("Data block marshalling failed")
-		}
+// Blocks written but not yet added to a SharingRecord
+type blockList struct {
+	fileID  string // of the file new blocks are signed for
+	address []string
+	symmKey [][]byte
+	hashes  [][]byte
+	lengths []int
+}
+
+func (blocks *blockList) appendTo(shrecord *SharingRecord) {
+	shrecord.Address = append(shrecord.Address, blocks.address...)
+	shrecord.SymmKey = append(shrecord.SymmKey, blocks.symmKey...)
+	shrecord.Hashes = append(shrecord.Hashes, blocks.hashes...)
+	shrecord.Lengths = append(shrecord.Lengths, blocks.lengths...)
+}
 
-		cipherdata := make([]byte, BlockSize+len(dblockMarsh))
-		iv = cipherdata[:BlockSize]
-		copy(iv, userlib.RandomBytes(BlockSize))
+func (blocks *blockList) add(address string, dbkey []byte, hash []byte,
+	length int) {
+	blocks.address = append(blocks.address, address)
+	blocks.symmKey = append(blocks.symmKey, dbkey)
+	blocks.hashes = append(blocks.hashes, hash)
+	blocks.lengths = append(blocks.lengths, length)
+}
 
-		// NOTE: The "key" needs to be of 16 bytes
-		cipher = userlib.CFBEncrypter(symmKey, iv) // Check [:16]
-		cipher.XORKeyStream(cipherdata[BlockSize:], []byte(dblockMarsh))
+// Adds block i of a SharingRecord to the list as it is
+func (blocks *blockList) keep(shrecord *SharingRecord, i int) {
+	blocks.add(shrecord.Address[i], shrecord.SymmKey[i], shrecord.Hashes[i],
+		shrecord.Lengths[i])
+}
 
-		// Data blocks stored at different locations
-		userlib.DatastoreDelete(dbKey)
-		userlib.DatastoreDelete(address)
-		userlib.DatastoreSet(address, cipherdata)
+// Writes value as a new block under a fresh address and key and adds
+// it to the list.  On failure the blocks already on the list are
+// reported as leftovers of op.
+func (user *User) storeChunk(op string, blocks *blockList,
+	value []byte) error {
+	address, dbkey := newAddress(), newSymmKey()
+	hash, err := user.storeBlock(blocks.fileID, address, dbkey, value)
+	if err != nil {
+		return &WriteError{Op: op, Leftover: blocks.address, Err: err}
+	}
+	blocks.add(address, dbkey, hash, len(value))
+	return nil
+}
 
+// Splits data into chunks of the backend's chunk size and writes each
+// as a block, see storeChunk
+func (user *User) storeChunks(op string, blocks *blockList,
+	data []byte) error {
+	size := user.backend.chunkSize()
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := user.storeChunk(op, blocks, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
 	}
+	return nil
+}
 
-	// HMAC Signature via symmetric keys
-	// Store the signature of SharingRecord_r.SharingRecord in Signature
-	shrMarsh, err = json.Marshal(shrecord.SharingRecord)
+// Signs value as ours for the file fileID, then seals it, pushes it to
+// address and returns its hash
+func (user *User) storeBlock(fileID string, address string, dbkey []byte,
+	value []byte) (hash []byte, err error) {
+	nonce := userlib.RandomBytes(16)
+	claim, err := json.Marshal(blockClaim{FileID: fileID,
+		Author: user.Username, Nonce: nonce, Value: value})
 	if err != nil {
-		return errors.New("SharingRecord_r.SharingRecord Marshalling failed")
+		return nil, errors.New("Block claim Marshalling failed")
 	}
-	mac = userlib.NewHMAC(file.Inode.SymmKey)
-	mac.Write(shrMarsh)
-	shrecord.Signature = mac.Sum(nil)
-
-	// Finally, encrypt the whole SharingRecord_r structure
-	shrecord_rMarsh, err := json.Marshal(shrecord)
+	sig, err := userlib.RSASign(user.Privkey, claim)
 	if err != nil {
-		return errors.New("SharingRecord_r Marshalling failed")
+		return nil, errors.New("RSA Signing of block failed")
 	}
+	return user.storeData(address, dbkey, &Data{Value: value,
+		Author: user.Username, Nonce: nonce, Signature: sig})
+}
 
-	ciphertext := make([]byte, BlockSize+len(shrecord_rMarsh))
-	iv = ciphertext[:BlockSize]
-	copy(iv, userlib.RandomBytes(BlockSize))
-
-	// NOTE: The "key" needs to be of 16 bytes
-	cipher = userlib.CFBEncrypter(file.Inode.SymmKey, iv) // Check [:16]
-	cipher.XORKeyStream(ciphertext[BlockSize:], []byte(shrecord_rMarsh))
-
-	//
-	// Push the RSA Encrypted Inode structure to Data Store
-	userlib.DatastoreDelete(fileKey)
-	userlib.DatastoreSet(fileKey, encryptedMarsh1)
-
-	// Push the AES-CFB Encrypted SharingRecord structure to Data Store
-	userlib.DatastoreDelete(file.Inode.ShRecordAddr)
-	userlib.DatastoreSet(file.Inode.ShRecordAddr, ciphertext)
-
-	// Delete previous values
-	userlib.DatastoreDelete(prevAddr)
-	return nil
+// Seals an already signed data block, pushes it to address and returns
+// its hash
+func (user *User) storeData(address string, dbkey []byte,
+	data *Data) (hash []byte, err error) {
+	if len(data.Merged) > 0 {
+		stored := *data
+		stored.Value = nil
+		data = &stored
+	}
+	sealed, err := seal(address, dbkey, data)
+	if err != nil {
+		return nil, err
+	}
+	if err = user.datastore().Set(address, sealed); err != nil {
+		return nil, err
+	}
+	return blockHash(sealed), nil
 }
@@ -1,8 +1,12 @@
 package assn1
 
 import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/fenilfadadu/cs628-assn1/userlib"
 )
@@ -206,23 +210,908 @@ func TestRevokeTransitive(t *testing.T) {
 	apple, _ := u1.LoadFile("file11")
 	t.Log(string(apple))
 
-	// Bob revokes all other access
+	// Bob is only a collaborator: he can't revoke alice's file
 	err = u2.RevokeFile("file13")
 	t.Log("Can't revoke other's file ", err.Error())
 	err = u2.RevokeFile("file12")
+	if !errors.Is(err, ErrPermission) {
+		t.Error("Bob revoked a file he doesn't own, ", err)
+	}
+	if _, err = u3.LoadFile("file13"); err != nil {
+		t.Error("Bob's failed revoke locked charles out, ", err)
+	}
+
+	// Alice, the owner, revokes all other access
+	err = u1.RevokeFile("file11")
 	if err != nil {
-		t.Error("Bob couldn't revoke his own file, ", err.Error())
+		t.Error("Alice couldn't revoke her own file, ", err.Error())
 	}
 
-	_, err1 := u1.LoadFile("file11")
+	_, err1 := u2.LoadFile("file12")
 	_, err2 = u3.LoadFile("file13")
 	if err1 == nil || err2 == nil {
-		t.Error("Alice and Charles bypassed revoke call by bob")
+		t.Error("Bob and Charles bypassed revoke call by alice")
 	}
 
-	apple, err = u2.LoadFile("file12")
+	apple, err = u1.LoadFile("file11")
 	t.Log(string(apple), err)
+	if err != nil {
+		t.Error("Alice lost access to her own file, ", err)
+	}
+}
+
+// Returns a Backend on fresh in-memory stores, and its Datastore
+func newBackend() (Backend, *userlib.MemDatastore) {
+	ds := userlib.NewMemDatastore()
+	return Backend{Datastore: ds, Keystore: userlib.NewMemKeystore()}, ds
+}
+
+// Creates the named users on b, each with the password name+"pass"
+func initUsers(t *testing.T, b Backend, names ...string) []*User {
+	t.Helper()
+	users := make([]*User, len(names))
+	for i, name := range names {
+		u, err := b.InitUser(name, name+"pass")
+		if err != nil {
+			t.Fatal("Failed to initialize", name, err)
+		}
+		users[i] = u
+	}
+	return users
+}
+
+func TestBackendIsolation(t *testing.T) {
+	ds1 := userlib.NewMemDatastore()
+	ds2 := userlib.NewMemDatastore()
+	ks := userlib.NewMemKeystore()
+	b1 := Backend{Datastore: ds1, Keystore: ks}
+	b2 := Backend{Datastore: ds2, Keystore: ks}
+
+	u, err := b1.InitUser("dave", "davepass")
+	if err != nil {
+		t.Fatal("Failed to initialize dave", err)
+	}
+	u.StoreFile("isolated", []byte("Only in the first store"))
+
+	// The session must not leak into the default or the other store
+	if _, err = GetUser("dave", "davepass"); err == nil {
+		t.Error("dave found in the default datastore")
+	}
+	if _, err = b2.GetUser("dave", "davepass"); err == nil {
+		t.Error("dave found in the second datastore")
+	}
+
+	u, err = b1.GetUser("dave", "davepass")
+	if err != nil {
+		t.Fatal("Failed to reload dave", err)
+	}
+	v, err := u.LoadFile("isolated")
+	if err != nil || string(v) != "Only in the first store" {
+		t.Error("Failed to load from the bound datastore", err)
+	}
+
+	// Every write went through the bound store
+	if len(ds1.Keys()) == 0 || len(ds2.Keys()) != 0 {
+		t.Error("Writes did not go to the bound datastore")
+	}
+}
+
+func TestInitUserTaken(t *testing.T) {
+	b, _ := newBackend()
+	initUsers(t, b, "erin")
+	// Same name, different password: the registered key must survive
+	if _, err := b.InitUser("erin", "otherpass"); err == nil {
+		t.Error("Registered a username twice")
+	}
+	if _, err := b.GetUser("erin", "erinpass"); err != nil {
+		t.Error("Original erin can't log in anymore", err)
+	}
+	if len(b.Keystore.History()) != 1 {
+		t.Error("Unexpected key history", b.Keystore.History())
+	}
+}
+
+func TestPersistentBackend(t *testing.T) {
+	dir := t.TempDir()
+	open := func() (Backend, func()) {
+		ds, err := userlib.OpenFileDatastore(filepath.Join(dir, "data"))
+		if err != nil {
+			t.Fatal("Failed to open the datastore", err)
+		}
+		ks, err := userlib.OpenFileKeystore(filepath.Join(dir, "keys"))
+		if err != nil {
+			t.Fatal("Failed to open the keystore", err)
+		}
+		return Backend{Datastore: ds, Keystore: ks}, func() { ks.Close() }
+	}
+
+	b, closeStores := open()
+	u, err := b.InitUser("frank", "frankpass")
+	if err != nil {
+		t.Fatal("Failed to initialize frank", err)
+	}
+	u.StoreFile("durable", []byte("Survives restarts"))
+	closeStores()
+
+	// "Restart" with fresh handles on the same directory
+	b, closeStores = open()
+	defer closeStores()
+	u, err = b.GetUser("frank", "frankpass")
+	if err != nil {
+		t.Fatal("Failed to reload frank after restart", err)
+	}
+	v, err := u.LoadFile("durable")
+	if err != nil || string(v) != "Survives restarts" {
+		t.Error("File lost across restart", err)
+	}
+}
+
+func TestResumeSession(t *testing.T) {
+	b, _ := newBackend()
+	u := initUsers(t, b, "gina")[0]
+	u.StoreFile("notes", []byte("Resumed"))
+
+	session, err := u.Session()
+	if err != nil {
+		t.Fatal("Failed to save the session", err)
+	}
+	u, err = b.ResumeSession(session)
+	if err != nil {
+		t.Fatal("Failed to resume the session", err)
+	}
+	v, err := u.LoadFile("notes")
+	if err != nil || string(v) != "Resumed" {
+		t.Error("Resumed session can't load files", err)
+	}
+
+	// A session only resumes against the keystore it belongs to
+	other, _ := newBackend()
+	if _, err = other.ResumeSession(session); err == nil {
+		t.Error("Resumed a session against a foreign keystore")
+	}
+}
+
+// Returns the keys that appeared in ds since before was taken
+func newKeys(ds *userlib.MemDatastore, before []string) []string {
+	seen := make(map[string]bool)
+	for _, k := range before {
+		seen[k] = true
+	}
+	var added []string
+	for _, k := range ds.Keys() {
+		if !seen[k] {
+			added = append(added, k)
+		}
+	}
+	return added
+}
+
+func TestTypedErrors(t *testing.T) {
+	b, ds := newBackend()
+	u := initUsers(t, b, "hank")[0]
+
+	_, err := b.InitUser("hank", "hankpass")
+	if !errors.Is(err, ErrAlreadyExists) {
+		t.Error("Expected ErrAlreadyExists, got", err)
+	}
+	if _, err = b.GetUser("hank", "wrongpass"); !errors.Is(err, ErrWrongCredentials) {
+		t.Error("Expected ErrWrongCredentials, got", err)
+	}
+	if _, err = b.GetUser("nobody", "pass"); !errors.Is(err, ErrNotFound) {
+		t.Error("Expected ErrNotFound for a user, got", err)
+	}
+	if _, err = u.LoadFile("missing"); !errors.Is(err, ErrNotFound) {
+		t.Error("Expected ErrNotFound for a file, got", err)
+	}
+	if _, err = u.ShareFile("missing", "nobody"); !errors.Is(err, ErrNotFound) {
+		t.Error("Expected ErrNotFound for a share, got", err)
+	}
+
+	u.StoreFile("ledger", []byte("first"))
+	before := ds.Keys()
+	if err = u.AppendFile("ledger", []byte("second")); err != nil {
+		t.Fatal("Append failed", err)
+	}
+
+	// Corrupt every value the append touched: the SharingRecord is
+	// rewritten in place, so only the new block shows up as new
+	added := newKeys(ds, before)
+	if len(added) != 1 {
+		t.Fatal("Expected one new block, got", len(added))
+	}
+	value, _ := ds.Get(added[0])
+	value[len(value)/2] ^= 0xff
+	ds.Set(added[0], value)
+
+	_, err = u.LoadFile("ledger")
+	var integrity *IntegrityError
+	if !errors.Is(err, ErrIntegrity) || !errors.As(err, &integrity) {
+		t.Fatal("Expected an IntegrityError, got", err)
+	}
+	if integrity.Structure != StructData || integrity.Block != 1 {
+		t.Error("Wrong failure reported", integrity)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Error("Tampering reported as a missing file")
+	}
+}
+
+// A Datastore that starts failing writes once armed, and fails every
+// lookup while down
+type faultyDatastore struct {
+	*userlib.MemDatastore
+	failAfter int // Set calls to let through, -1 means never fail
+	down      bool
+}
+
+func (f *faultyDatastore) GetChecked(key string) ([]byte, bool, error) {
+	if f.down {
+		return nil, false, errors.New("injected read failure")
+	}
+	value, ok := f.MemDatastore.Get(key)
+	return value, ok, nil
+}
+
+func (f *faultyDatastore) Set(key string, value []byte) error {
+	if f.failAfter == 0 {
+		return errors.New("injected write failure")
+	}
+	if f.failAfter > 0 {
+		f.failAfter--
+	}
+	return f.MemDatastore.Set(key, value)
+}
+
+func TestStoreFileErrors(t *testing.T) {
+	b, mem := newBackend()
+	ds := &faultyDatastore{MemDatastore: mem}
+	b.Datastore = ds
+
+	// A User that can't be stored doesn't take the name
+	if _, err := b.InitUser("ivan", "ivanpass"); err == nil {
+		t.Fatal("InitUser ignored a failed write")
+	}
+	ds.failAfter = -1
+	u := initUsers(t, b, "ivan")[0]
+	if err := u.StoreFile("report", []byte("v1")); err != nil {
+		t.Fatal("StoreFile failed", err)
+	}
+
+	// The data block goes through, the SharingRecord doesn't
+	ds.failAfter = 1
+	err := u.StoreFile("report", []byte("v2"))
+	var werr *WriteError
+	if !errors.Is(err, ErrPartialWrite) || !errors.As(err, &werr) || werr.Committed {
+		t.Error("Expected an uncommitted partial write, got", err)
+	}
+	ds.failAfter = -1
+	v, err := u.LoadFile("report")
+	if err != nil || string(v) != "v1" {
+		t.Error("Failed write changed the file", string(v), err)
+	}
+
+	// Nothing is written at all
+	ds.failAfter = 0
+	err = u.StoreFile("fresh", []byte("data"))
+	if err == nil || errors.Is(err, ErrPartialWrite) {
+		t.Error("Expected a clean write failure, got", err)
+	}
+	ds.failAfter = -1
+	if _, err = u.LoadFile("fresh"); !errors.Is(err, ErrNotFound) {
+		t.Error("Failed StoreFile created the file", err)
+	}
+
+	// A failed lookup is not a missing file or user
+	ds.down = true
+	if err = u.StoreFile("report", []byte("v3")); err == nil ||
+		errors.Is(err, ErrNotFound) {
+		t.Error("Expected a read failure, got", err)
+	}
+	if _, err = b.GetUser("ivan", "ivanpass"); err == nil ||
+		errors.Is(err, ErrWrongCredentials) || errors.Is(err, ErrNotFound) {
+		t.Error("Expected a read failure, got", err)
+	}
+	ds.down = false
+	if v, err = u.LoadFile("report"); err != nil || string(v) != "v1" {
+		t.Error("Failed lookup changed the file", string(v), err)
+	}
+
+	// A tampered Inode must not silently swallow the write
+	ds.Set(u.GetInodeKey("report"), []byte("[]"))
+	if err = u.StoreFile("report", []byte("v3")); !errors.Is(err, ErrIntegrity) {
+		t.Error("Expected ErrIntegrity, got", err)
+	}
+}
+
+func TestMsgidMisuse(t *testing.T) {
+	b, _ := newBackend()
+	u := initUsers(t, b, "alice", "bob", "carol")
+	alice, bob, carol := u[0], u[1], u[2]
+	if err := alice.StoreFile("plans", []byte("secret plans")); err != nil {
+		t.Fatal("StoreFile failed", err)
+	}
+	msgid, err := alice.ShareFile("plans", "bob")
+	if err != nil {
+		t.Fatal("ShareFile failed", err)
+	}
+
+	// Only bob can open it, and only as coming from alice
+	if err = carol.ReceiveFile("plans", "alice", msgid); !errors.Is(err, ErrIntegrity) {
+		t.Error("carol received bob's msgid", err)
+	}
+	if err = bob.ReceiveFile("plans", "carol", msgid); !errors.Is(err, ErrIntegrity) {
+		t.Error("Accepted a msgid from the wrong sender", err)
+	}
+	tampered := []byte(msgid)
+	tampered[len(tampered)/2] ^= 1
+	if err = bob.ReceiveFile("plans", "alice", string(tampered)); err == nil {
+		t.Error("Accepted a tampered msgid")
+	}
+
+	if err = bob.ReceiveFile("plans", "alice", msgid); err != nil {
+		t.Fatal("ReceiveFile failed", err)
+	}
+	v, err := bob.LoadFile("plans")
+	if err != nil || string(v) != "secret plans" {
+		t.Error("Shared file is not the same", string(v), err)
+	}
+}
+
+func TestForgedOwnership(t *testing.T) {
+	b, _ := newBackend()
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+	alice.StoreFile("deed", []byte("Alice owns this"))
+	msgid, _ := alice.ShareFile("deed", "bob")
+	if err := bob.ReceiveFile("deed", "alice", msgid); err != nil {
+		t.Fatal("ReceiveFile failed", err)
+	}
+
+	// Bob knows the SharingRecord key, so he can rewrite the record
+	// and claim the file, but he can't produce alice's signature
+	_, file, err := bob.loadInode("deed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shrecord, err := bob.loadSharingRecord(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shrecord.MainAuthor = "bob"
+	bob.signOwnership(file, shrecord)
+	bob.storeSharingRecord(file, shrecord)
+
+	if _, err = alice.LoadFile("deed"); !errors.Is(err, ErrIntegrity) {
+		t.Error("Forged ownership went unnoticed by alice", err)
+	}
+	if _, err = bob.LoadFile("deed"); !errors.Is(err, ErrIntegrity) {
+		t.Error("Forged ownership went unnoticed by bob", err)
+	}
+	if err = bob.RevokeFile("deed"); err == nil {
+		t.Error("Bob revoked with a forged ownership")
+	}
+}
+
+func TestRevokeUser(t *testing.T) {
+	b, _ := newBackend()
+	u := initUsers(t, b, "alice", "bob", "carol", "dave")
+	alice, bob, carol, dave := u[0], u[1], u[2], u[3]
+
+	// alice -> bob -> carol, and alice -> dave
+	alice.StoreFile("roster", []byte("v1"))
+	msgid, _ := alice.ShareFile("roster", "bob")
+	if err := bob.ReceiveFile("roster", "alice", msgid); err != nil {
+		t.Fatal("bob failed to receive", err)
+	}
+	msgid, _ = bob.ShareFile("roster", "carol")
+	if err := carol.ReceiveFile("roster", "bob", msgid); err != nil {
+		t.Fatal("carol failed to receive", err)
+	}
+	msgid, _ = alice.ShareFile("roster", "dave")
+	if err := dave.ReceiveFile("roster", "alice", msgid); err != nil {
+		t.Fatal("dave failed to receive", err)
+	}
+
+	if err := bob.RevokeUser("roster", "carol"); !errors.Is(err, ErrPermission) {
+		t.Error("Expected ErrPermission for bob, got", err)
+	}
+	if err := alice.RevokeUser("roster", "erin"); !errors.Is(err, ErrNotFound) {
+		t.Error("Expected ErrNotFound for a stranger, got", err)
+	}
 
-	// t.Log(err1, err2)
+	if err := alice.RevokeUser("roster", "bob"); err != nil {
+		t.Fatal("RevokeUser failed", err)
+	}
+	for _, u := range []*User{bob, carol} {
+		if _, err := u.LoadFile("roster"); err == nil {
+			t.Error(u.Username, "still has access")
+		}
+	}
+	if err := dave.AppendFile("roster", []byte("v2")); err != nil {
+		t.Error("dave lost access", err)
+	}
+	v, err := alice.LoadFile("roster")
+	if err != nil || string(v) != "v1v2" {
+		t.Error("alice can't read dave's append", string(v), err)
+	}
+
+	// bob's old keys open nothing that is still stored
+	if err = bob.AppendFile("roster", []byte("evil")); err == nil {
+		t.Error("bob appended after revocation")
+	}
+	v, _ = dave.LoadFile("roster")
+	if string(v) != "v1v2" {
+		t.Error("Revoked append went through", string(v))
+	}
+}
+
+func TestRevokeUserOtherGrants(t *testing.T) {
+	// carol gets the file from bob and from alice, in either order:
+	// revoking bob only takes bob's share
+	for _, ownerFirst := range []bool{false, true} {
+		b, _ := newBackend()
+		u := initUsers(t, b, "alice", "bob", "carol")
+		alice, bob, carol := u[0], u[1], u[2]
+		alice.StoreFile("g", []byte("group"))
+		msgid, _ := alice.ShareFile("g", "bob")
+		bob.ReceiveFile("g", "alice", msgid)
+
+		shares := []func(){
+			func() {
+				msgid, _ := bob.ShareFile("g", "carol")
+				carol.ReceiveFile("from-bob", "bob", msgid)
+			},
+			func() {
+				msgid, _ := alice.ShareFile("g", "carol")
+				carol.ReceiveFile("from-alice", "alice", msgid)
+			},
+		}
+		if ownerFirst {
+			shares[0], shares[1] = shares[1], shares[0]
+		}
+		shares[0]()
+		shares[1]()
+
+		if err := alice.RevokeUser("g", "bob"); err != nil {
+			t.Fatal("RevokeUser failed", err)
+		}
+		if v, err := carol.LoadFile("from-alice"); err != nil || string(v) != "group" {
+			t.Error("carol lost alice's grant", ownerFirst, string(v), err)
+		}
+		for _, c := range []struct {
+			u    *User
+			name string
+		}{{bob, "g"}, {carol, "from-bob"}} {
+			if _, err := c.u.LoadFile(c.name); err == nil {
+				t.Error(c.u.Username, "kept access through bob", ownerFirst)
+			}
+		}
+	}
+}
+
+func TestListCollaborators(t *testing.T) {
+	b, _ := newBackend()
+	u := initUsers(t, b, "alice", "bob", "carol", "dave")
+	alice, bob, carol := u[0], u[1], u[2]
+
+	alice.StoreFile("minutes", []byte("notes"))
+	tree, err := alice.ListCollaborators("minutes")
+	if err != nil || len(tree) != 0 {
+		t.Error("Unshared file has collaborators", tree, err)
+	}
+
+	start := time.Now().Add(-time.Second)
+	msgid, _ := alice.ShareFile("minutes", "bob")
+	bob.ReceiveFile("minutes", "alice", msgid)
+	msgid, _ = bob.ShareFile("minutes", "carol")
+	carol.ReceiveFile("minutes", "bob", msgid)
+	alice.ShareFile("minutes", "dave")
+
+	want := [][2]string{{"alice", "bob"}, {"bob", "carol"}, {"alice", "dave"}}
+	for _, u := range []*User{alice, carol} {
+		tree, err = u.ListCollaborators("minutes")
+		if err != nil || len(tree) != len(want) {
+			t.Fatal("Wrong sharing tree for", u.Username, tree, err)
+		}
+		for i, c := range tree {
+			if c.Grantor != want[i][0] || c.Grantee != want[i][1] ||
+				c.Time.Before(start) {
+				t.Error("Wrong grant", i, c)
+			}
+		}
+	}
+
+	// A grant bob makes up for alice doesn't verify
+	_, file, _ := bob.loadInode("minutes")
+	shrecord, _ := bob.loadSharingRecord(file)
+	forged := shrecord.Grants[1]
+	forged.Grantor, forged.Grantee = "alice", "mallory"
+	shrecord.Grants = append(shrecord.Grants, forged)
+	bob.storeSharingRecord(file, shrecord)
+
+	alice.RevokeUser("minutes", "bob")
+	tree, err = alice.ListCollaborators("minutes")
+	if err != nil || len(tree) != 1 || tree[0].Grantee != "dave" {
+		t.Error("Wrong sharing tree after revocation", tree, err)
+	}
+}
+
+func TestReadOnlyShare(t *testing.T) {
+	b, ds := newBackend()
+	u := initUsers(t, b, "alice", "bob", "carol")
+	alice, bob, carol := u[0], u[1], u[2]
+
+	alice.StoreFile("spec", []byte("v1"))
+	msgid, err := alice.ShareFileWithMode("spec", "bob", ReadOnly)
+	if err != nil {
+		t.Fatal("ShareFileWithMode failed", err)
+	}
+	if err = bob.ReceiveFile("spec", "alice", msgid); err != nil {
+		t.Fatal("ReceiveFile failed", err)
+	}
+	msgid, _ = alice.ShareFileWithMode("spec", "carol", ReadWrite)
+	carol.ReceiveFile("spec", "alice", msgid)
+
+	if v, err := bob.LoadFile("spec"); err != nil || string(v) != "v1" {
+		t.Error("bob can't read", string(v), err)
+	}
+	if err = bob.AppendFile("spec", []byte("x")); !errors.Is(err, ErrPermission) {
+		t.Error("Expected ErrPermission for append, got", err)
+	}
+	if err = bob.StoreFile("spec", []byte("x")); !errors.Is(err, ErrPermission) {
+		t.Error("Expected ErrPermission for store, got", err)
+	}
+	if _, err = bob.ShareFile("spec", "carol"); !errors.Is(err, ErrPermission) {
+		t.Error("Expected ErrPermission for share, got", err)
+	}
+	if err = carol.AppendFile("spec", []byte("v2")); err != nil {
+		t.Error("carol can't append", err)
+	}
+
+	tree, _ := alice.ListCollaborators("spec")
+	if len(tree) != 2 || tree[0].Mode != ReadOnly || tree[1].Mode != ReadWrite {
+		t.Error("Wrong modes in the sharing tree", tree)
+	}
+
+	// Going around the client checks: bob can rewrite a block under
+	// the key he knows...
+	_, file, _ := bob.loadInode("spec")
+	shrecord, _ := bob.loadSharingRecord(file)
+	value, _ := ds.Get(shrecord.Address[0])
+	evil, _ := seal(shrecord.Address[0], shrecord.SymmKey[0],
+		&Data{Value: []byte("v0")})
+	ds.Set(shrecord.Address[0], evil)
+	if _, err = carol.LoadFile("spec"); !errors.Is(err, ErrIntegrity) {
+		t.Error("Rewritten block went unnoticed", err)
+	}
+	ds.Set(shrecord.Address[0], value)
+
+	// ...and the SharingRecord, but he can't sign either
+	shrecord.Address = shrecord.Address[:1]
+	shrecord.SymmKey = shrecord.SymmKey[:1]
+	shrecord.Hashes = shrecord.Hashes[:1]
+	shrecord.Lengths = shrecord.Lengths[:1]
+	storeSealed(ds, file.ShRecordAddr, file.SymmKey, shrecord)
+	if _, err = alice.LoadFile("spec"); !errors.Is(err, ErrIntegrity) {
+		t.Error("Unsigned SharingRecord went unnoticed", err)
+	}
+}
+
+func TestBlockAuthors(t *testing.T) {
+	b, _ := newBackend()
+	u := initUsers(t, b, "alice", "bob", "carol")
+	alice, bob, carol := u[0], u[1], u[2]
+
+	alice.StoreFile("log", []byte("one "))
+	for _, u := range []*User{bob, carol} {
+		msgid, _ := alice.ShareFile("log", u.Username)
+		if err := u.ReceiveFile("log", "alice", msgid); err != nil {
+			t.Fatal(u.Username, "failed to receive", err)
+		}
+	}
+	bob.AppendFile("log", []byte("two "))
+	carol.AppendFile("log", []byte("three"))
+
+	check := func(want []BlockAuthor) {
+		t.Helper()
+		v, authors, err := alice.LoadFileWithAuthors("log")
+		if err != nil || string(v) != "one two three" {
+			t.Fatal("LoadFileWithAuthors failed", string(v), err)
+		}
+		if !reflect.DeepEqual(authors, want) {
+			t.Error("Wrong authors", authors)
+		}
+	}
+	check([]BlockAuthor{{"alice", 0, 4}, {"bob", 4, 4}, {"carol", 8, 5}})
+
+	// Moving the blocks around keeps their authors
+	if err := alice.RevokeUser("log", "carol"); err != nil {
+		t.Fatal("RevokeUser failed", err)
+	}
+	check([]BlockAuthor{{"alice", 0, 4}, {"bob", 4, 4}, {"carol", 8, 5}})
+
+	// bob can write, but not in alice's name: he can't sign for her,
+	// copy a block she wrote into another file, or list hers twice
+	alice.StoreFile("other", []byte("!"))
+	msgid, _ := alice.ShareFile("other", "bob")
+	bob.ReceiveFile("other", "alice", msgid)
+	_, file, _ := bob.loadInode("other")
+	shrecord, _ := bob.loadSharingRecord(file)
+	copied, _ := bob.loadBlock(shrecord, 0)
+	_, file, _ = bob.loadInode("log")
+	shrecord, _ = bob.loadSharingRecord(file)
+	replayed, _ := bob.loadBlock(shrecord, 0)
+	claim, _ := json.Marshal(blockClaim{FileID: shrecord.FileID,
+		Author: "bob", Value: []byte("!")})
+	sig, _ := userlib.RSASign(bob.Privkey, claim)
+	forged := &Data{Value: []byte("!"), Author: "alice", Signature: sig}
+
+	for _, data := range []*Data{forged, copied, replayed} {
+		shrecord, _ = bob.loadSharingRecord(file)
+		n := len(shrecord.Address)
+		address, dbkey := newAddress(), newSymmKey()
+		hash, _ := bob.storeData(address, dbkey, data)
+		shrecord.Address = append(shrecord.Address, address)
+		shrecord.SymmKey = append(shrecord.SymmKey, dbkey)
+		shrecord.Hashes = append(shrecord.Hashes, hash)
+		shrecord.Lengths = append(shrecord.Lengths, len(data.Value))
+		bob.storeSharingRecord(file, shrecord)
+
+		_, _, err := alice.LoadFileWithAuthors("log")
+		var integrity *IntegrityError
+		if !errors.As(err, &integrity) || integrity.Block != 3 {
+			t.Error("Block in alice's name went unnoticed", err)
+		}
+
+		shrecord.Address, shrecord.SymmKey = shrecord.Address[:n], shrecord.SymmKey[:n]
+		shrecord.Hashes, shrecord.Lengths = shrecord.Hashes[:n], shrecord.Lengths[:n]
+		bob.storeSharingRecord(file, shrecord)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	b, ds := newBackend()
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+
+	alice.StoreFile("ledger", []byte("v1"))
+	msgid, _ := alice.ShareFile("ledger", "bob")
+	bob.ReceiveFile("ledger", "alice", msgid)
+
+	// The server keeps a copy of the record as it is now, and alice's
+	// session as of now is another client that saw it
+	_, file, _ := alice.loadInode("ledger")
+	old, _ := ds.Get(file.ShRecordAddr)
+	session, _ := alice.Session()
+
+	if err := alice.AppendFile("ledger", []byte("v2")); err != nil {
+		t.Fatal("AppendFile failed", err)
+	}
+	if v, err := bob.LoadFile("ledger"); err != nil || string(v) != "v1v2" {
+		t.Fatal("LoadFile failed", string(v), err)
+	}
+
+	// Replaying the old record is a rollback, also for a resumed
+	// session
+	ds.Set(file.ShRecordAddr, old)
+	if _, err := bob.LoadFile("ledger"); !errors.Is(err, ErrRollback) ||
+		!errors.Is(err, ErrIntegrity) {
+		t.Error("Expected ErrRollback, got", err)
+	}
+	saved, _ := bob.Session()
+	resumed, err := b.ResumeSession(saved)
+	if err != nil {
+		t.Fatal("ResumeSession failed", err)
+	}
+	if err = resumed.AppendFile("ledger", []byte("x")); !errors.Is(err, ErrRollback) {
+		t.Error("Expected ErrRollback after resuming, got", err)
+	}
+
+	// A client that only saw the old record writes on top of it: the
+	// server now shows bob a different history
+	stale, err := b.ResumeSession(session)
+	if err != nil {
+		t.Fatal("ResumeSession failed", err)
+	}
+	if err = stale.AppendFile("ledger", []byte("v2'")); err != nil {
+		t.Fatal("AppendFile failed", err)
+	}
+	if _, err = bob.LoadFile("ledger"); !errors.Is(err, ErrFork) {
+		t.Error("Expected ErrFork, got", err)
+	}
+
+	// alice saw the original history too, while the stale client just
+	// keeps seeing newer versions
+	if err = alice.AppendFile("ledger", []byte("v3")); !errors.Is(err, ErrFork) {
+		t.Error("Expected ErrFork for alice, got", err)
+	}
+	if err = stale.AppendFile("ledger", []byte("v3")); err != nil {
+		t.Error("AppendFile failed", err)
+	}
+}
+
+// A file deleted and created again under the same name is a new file,
+// not a rollback of the old one
+func TestRecreateFile(t *testing.T) {
+	b, _ := newBackend()
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+
+	// bob sees a file in a directory shared with him, and a second
+	// session of alice's sees a top-level file, both at version 2
+	alice.MkDir("proj")
+	alice.StoreFile("proj/notes", []byte("a"))
+	alice.StoreFile("todo", []byte("a"))
+	msgid, _ := alice.ShareFile("proj", "bob")
+	bob.ReceiveFile("mnt", "alice", msgid)
+	session, _ := alice.Session()
+	other, err := b.ResumeSession(session)
+	if err != nil {
+		t.Fatal("ResumeSession failed", err)
+	}
+	for _, name := range []string{"proj/notes", "todo"} {
+		alice.AppendFile(name, []byte("b"))
+		alice.AppendFile(name, []byte("c"))
+	}
+	if v, err := bob.LoadFile("mnt/notes"); err != nil || string(v) != "abc" {
+		t.Fatal("LoadFile failed", string(v), err)
+	}
+	if v, err := other.LoadFile("todo"); err != nil || string(v) != "abc" {
+		t.Fatal("LoadFile failed", string(v), err)
+	}
+
+	for _, name := range []string{"proj/notes", "todo"} {
+		if err = alice.DeleteFile(name); err != nil {
+			t.Fatal("DeleteFile failed", err)
+		}
+		if err = alice.StoreFile(name, []byte("new")); err != nil {
+			t.Fatal("StoreFile failed", err)
+		}
+	}
+	if v, err := bob.LoadFile("mnt/notes"); err != nil || string(v) != "new" {
+		t.Error("Recreated file in a shared directory", string(v), err)
+	}
+	if v, err := other.LoadFile("todo"); err != nil || string(v) != "new" {
+		t.Error("Recreated top-level file", string(v), err)
+	}
+}
+
+func TestChunking(t *testing.T) {
+	b, ds := newBackend()
+	b.ChunkSize = 4
+	u := initUsers(t, b, "judy")[0]
+
+	before := ds.Keys()
+	if err := u.StoreFile("notes", []byte("0123456789")); err != nil {
+		t.Fatal("StoreFile failed", err)
+	}
+	// Three blocks, the SharingRecord, the Inode and (for the first
+	// file) the index
+	if added := newKeys(ds, before); len(added) != 6 {
+		t.Error("Expected 6 new values, got", len(added))
+	}
+	if err := u.AppendFile("notes", []byte("abcdef")); err != nil {
+		t.Fatal("AppendFile failed", err)
+	}
+	if err := u.AppendFile("notes", nil); err != nil {
+		t.Fatal("Empty AppendFile failed", err)
+	}
+
+	_, authors, err := u.LoadFileWithAuthors("notes")
+	if err != nil || len(authors) != 5 {
+		t.Fatal("Expected 5 blocks", authors, err)
+	}
+	for _, block := range authors {
+		if block.Length > 4 {
+			t.Error("Block over the chunk size", block)
+		}
+	}
+	v, _ := u.LoadFile("notes")
+	if string(v) != "0123456789abcdef" {
+		t.Error("Chunked file read back wrong", string(v))
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	b, ds := newBackend()
+	b.ChunkSize = 4
+	u := initUsers(t, b, "alice", "bob", "carol")
+	alice, bob, carol := u[0], u[1], u[2]
+
+	// Overwriting doesn't leave the old blocks behind
+	alice.StoreFile("draft", []byte("0123456789"))
+	stored := len(ds.Keys())
+	alice.StoreFile("draft", []byte("abcdefghij"))
+	if len(ds.Keys()) != stored {
+		t.Error("StoreFile left old blocks behind", len(ds.Keys())-stored)
+	}
+
+	for _, u := range []*User{bob, carol} {
+		msgid, _ := alice.ShareFile("draft", u.Username)
+		if err := u.ReceiveFile("draft", "alice", msgid); err != nil {
+			t.Fatal(u.Username, "failed to receive", err)
+		}
+	}
+
+	// A collaborator only drops their own share
+	if err := bob.DeleteFile("draft"); err != nil {
+		t.Fatal("bob's DeleteFile failed", err)
+	}
+	if _, err := bob.LoadFile("draft"); !errors.Is(err, ErrNotFound) {
+		t.Error("Deleted share still loads", err)
+	}
+	if v, err := carol.LoadFile("draft"); err != nil || string(v) != "abcdefghij" {
+		t.Error("bob's DeleteFile affected carol", string(v), err)
+	}
+	bob.StoreFile("draft", []byte("bob's own"))
+	if v, _ := alice.LoadFile("draft"); string(v) != "abcdefghij" {
+		t.Error("bob's new file replaced alice's", string(v))
+	}
+
+	// The owner deletes it for everybody, leaving only carol's Inode
+	before := ds.Keys()
+	if err := alice.DeleteFile("draft"); err != nil {
+		t.Fatal("alice's DeleteFile failed", err)
+	}
+	if _, err := carol.LoadFile("draft"); !errors.Is(err, ErrNotFound) {
+		t.Error("Deleted file still loads for carol", err)
+	}
+	if _, err := alice.LoadFile("draft"); !errors.Is(err, ErrNotFound) {
+		t.Error("Deleted file still loads for alice", err)
+	}
+	// The Inode, the SharingRecord, three blocks and two access nodes
+	if gone := len(before) - len(ds.Keys()); gone != 7 {
+		t.Error("Expected 7 values deleted, got", gone)
+	}
+	if err := carol.DeleteFile("draft"); err != nil {
+		t.Error("carol can't drop a dead share", err)
+	}
+	if err := alice.DeleteFile("draft"); !errors.Is(err, ErrNotFound) {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	b, _ := newBackend()
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+	alice.StoreFile("old", []byte("contents"))
+	alice.StoreFile("taken", []byte("other"))
+	msgid, _ := alice.ShareFile("old", "bob")
+	bob.ReceiveFile("shared", "alice", msgid)
+
+	if err := alice.RenameFile("old", "taken"); !errors.Is(err, ErrAlreadyExists) {
+		t.Error("Expected ErrAlreadyExists, got", err)
+	}
+	if err := alice.RenameFile("missing", "new"); !errors.Is(err, ErrNotFound) {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+
+	if err := alice.RenameFile("old", "new"); err != nil {
+		t.Fatal("Owner's RenameFile failed", err)
+	}
+	if err := bob.RenameFile("shared", "mine"); err != nil {
+		t.Fatal("Collaborator's RenameFile failed", err)
+	}
+	if _, err := alice.LoadFile("old"); !errors.Is(err, ErrNotFound) {
+		t.Error("Old name still loads", err)
+	}
 
+	// Still the same file, for both
+	if err := bob.AppendFile("mine", []byte("+bob")); err != nil {
+		t.Error("bob can't append after renaming", err)
+	}
+	if v, err := alice.LoadFile("new"); err != nil || string(v) != "contents+bob" {
+		t.Error("Renamed file is not the same", string(v), err)
+	}
+	tree, _ := alice.ListCollaborators("new")
+	if len(tree) != 1 || tree[0].Grantee != "bob" {
+		t.Error("Renaming changed the sharing tree", tree)
+	}
+	if err := alice.RevokeUser("new", "bob"); err != nil {
+		t.Error("Revoking a renamed file failed", err)
+	}
+	if _, err := bob.LoadFile("mine"); err == nil {
+		t.Error("bob kept access to a renamed file")
+	}
 }
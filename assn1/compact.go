@@ -0,0 +1,166 @@
+package assn1
+
+import (
+	"fmt"
+)
+
+// Compact merges runs of small data blocks, as left behind by many
+// appends, into blocks of up to the backend's chunk size and rewrites
+// the SharingRecord.  Merged blocks keep every piece signed by its
+// original author, so LoadFileWithAuthors reports the same authors.
+// Each piece adds its signature to the block, so a block merges at
+// most one piece per pieceOverhead bytes of the chunk size.
+//
+// Collaborators may keep appending meanwhile: their blocks are kept.
+// If the file was changed in any other way Compact gives up with
+// ErrConflict and leaves the file as it was.
+func (user *User) Compact(filename string) (err error) {
+	_, file, err := user.loadInode(filename)
+	if err != nil {
+		return err
+	}
+	shrecord, err := user.loadSharingRecord(file)
+	if err != nil {
+		return err
+	}
+	if file.WriteKey == nil {
+		return &PermissionError{Op: "Compact", Name: filename,
+			Reason: "read-only share"}
+	}
+
+	size := user.backend.chunkSize()
+	maxPieces := size / pieceOverhead
+	if maxPieces < 2 {
+		maxPieces = 2
+	}
+	n := len(shrecord.Address)
+	var blocks blockList
+	var written, garbage []string
+	for i := 0; i < n; {
+		j := i
+		for j < n && shrecord.Lengths[j] < size {
+			j++
+		}
+		if j-i < 2 {
+			// A full block, or a small one with nothing to merge with
+			blocks.keep(shrecord, i)
+			i++
+			continue
+		}
+
+		// Pack the pieces of blocks i..j-1 into as few blocks as fit
+		var groups [][]Data
+		var group []Data
+		groupSize := 0
+		for k := i; k < j; k++ {
+			block, err := user.loadBlock(shrecord, k)
+			if err != nil {
+				user.deleteAll(written)
+				return user.blockGone(filename, shrecord, err)
+			}
+			for _, piece := range block.pieces() {
+				full := groupSize+len(piece.Value) > size ||
+					len(group) == maxPieces
+				if full && len(group) > 0 {
+					groups = append(groups, group)
+					group, groupSize = nil, 0
+				}
+				group = append(group, piece)
+				groupSize += len(piece.Value)
+			}
+		}
+		groups = append(groups, group)
+
+		if len(groups) >= j-i {
+			for k := i; k < j; k++ {
+				blocks.keep(shrecord, k)
+			}
+			i = j
+			continue
+		}
+		for _, group := range groups {
+			data := &group[0]
+			if len(group) > 1 || data.Skip != 0 || data.Drop != 0 {
+				data = &Data{Merged: group}
+			}
+			address, dbkey := newAddress(), newSymmKey()
+			hash, err := user.storeData(address, dbkey, data)
+			if err != nil {
+				return &WriteError{Op: "Compact", Leftover: written, Err: err}
+			}
+			written = append(written, address)
+			length := 0
+			for _, piece := range group {
+				length += len(piece.content())
+			}
+			blocks.add(address, dbkey, hash, length)
+		}
+		garbage = append(garbage, shrecord.Address[i:j]...)
+		i = j
+	}
+	if len(written) == 0 {
+		return nil
+	}
+
+	// Look again right before committing: appends made in the meantime
+	// are carried over, anything else means our blocks are stale
+	snapshot := shrecord.Address
+	_, file, err = user.loadInode(filename)
+	if err == nil {
+		shrecord, err = user.loadSharingRecord(file)
+	}
+	if err != nil {
+		user.deleteAll(written)
+		return err
+	}
+	if !hasPrefix(shrecord.Address, snapshot) {
+		user.deleteAll(written)
+		return fmt.Errorf("Compact %q: %w", filename, ErrConflict)
+	}
+	for k := n; k < len(shrecord.Address); k++ {
+		blocks.keep(shrecord, k)
+	}
+	shrecord.Address, shrecord.SymmKey = nil, nil
+	shrecord.Hashes, shrecord.Lengths = nil, nil
+	blocks.appendTo(shrecord)
+
+	// The SharingRecord is the commit point
+	err = user.storeSharingRecord(file, shrecord)
+	if err != nil {
+		return &WriteError{Op: "Compact", Leftover: written, Err: err}
+	}
+	return user.deleteGarbage("Compact", garbage)
+}
+
+// About what a piece adds to a stored merged block besides its value:
+// the author, the nonce and the signature
+const pieceOverhead = 1 << 10
+
+// Compacts a file after an append took its block list past a multiple
+// of Backend.CompactAfter.  The append is already committed, so a
+// failed compaction is left for the next time.
+func (user *User) autoCompact(filename string, before int, after int) {
+	limit := user.backend.compactAfter()
+	if limit > 0 && before/limit != after/limit {
+		user.Compact(filename)
+	}
+}
+
+func hasPrefix(list []string, prefix []string) bool {
+	if len(list) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if list[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Best effort removal of values that were never committed
+func (user *User) deleteAll(addresses []string) {
+	for _, address := range addresses {
+		user.datastore().Delete(address)
+	}
+}
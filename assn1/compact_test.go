@@ -0,0 +1,170 @@
+package assn1
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/fenilfadadu/cs628-assn1/userlib"
+)
+
+// Runs hook (once) on the first Set after it is armed
+type hookDatastore struct {
+	*userlib.MemDatastore
+	hook func()
+}
+
+func (h *hookDatastore) Set(key string, value []byte) error {
+	if hook := h.hook; hook != nil {
+		h.hook = nil
+		hook()
+	}
+	return h.MemDatastore.Set(key, value)
+}
+
+func blockCount(t *testing.T, u *User, filename string) int {
+	t.Helper()
+	_, file, err := u.loadInode(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shrecord, err := u.loadSharingRecord(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(shrecord.Address)
+}
+
+func TestCompact(t *testing.T) {
+	b, mem := newBackend()
+	ds := &hookDatastore{MemDatastore: mem}
+	b.Datastore, b.ChunkSize = ds, 4<<10 // four pieces per merged block
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+	alice.StoreFile("log", []byte("a0"))
+	msgid, _ := alice.ShareFile("log", "bob")
+	bob.ReceiveFile("log", "alice", msgid)
+	for i := 1; i < 7; i++ {
+		u := alice
+		if i%2 == 1 {
+			u = bob
+		}
+		u.AppendFile("log", []byte{u.Username[0], byte('0' + i)})
+	}
+	want, wantAuthors, _ := alice.LoadFileWithAuthors("log")
+
+	_, file, _ := alice.loadInode("log")
+	old, _ := alice.loadSharingRecord(file)
+	if err := bob.Compact("log"); err != nil {
+		t.Fatal("Compact failed", err)
+	}
+	if n := blockCount(t, alice, "log"); n != 2 {
+		t.Error("Expected 2 blocks after Compact, got", n)
+	}
+	for _, address := range old.Address {
+		if _, status := ds.Get(address); status {
+			t.Error("Merged block left behind")
+		}
+	}
+	v, authors, err := alice.LoadFileWithAuthors("log")
+	if err != nil || string(v) != string(want) ||
+		!reflect.DeepEqual(authors, wantAuthors) {
+		t.Error("Compact changed the file", string(v), authors, err)
+	}
+
+	// Nothing left to merge
+	if err = alice.Compact("log"); err != nil || blockCount(t, alice, "log") != 2 {
+		t.Error("Second Compact changed the file", err)
+	}
+
+	// An append racing with the compaction survives it
+	alice.AppendFile("log", []byte("x"))
+	alice.AppendFile("log", []byte("y"))
+	ds.hook = func() { bob.AppendFile("log", []byte("z")) }
+	if err = alice.Compact("log"); err != nil {
+		t.Fatal("Compact failed", err)
+	}
+	v, _ = bob.LoadFile("log")
+	if string(v) != string(want)+"xyz" {
+		t.Error("Racing append lost", string(v))
+	}
+
+	// Anything else makes it give up
+	alice.AppendFile("log", []byte("1"))
+	alice.AppendFile("log", []byte("2"))
+	ds.hook = func() { bob.StoreFile("log", []byte("fresh")) }
+	if err = alice.Compact("log"); !errors.Is(err, ErrConflict) {
+		t.Error("Expected ErrConflict, got", err)
+	}
+	if v, _ = alice.LoadFile("log"); string(v) != "fresh" {
+		t.Error("Conflicting Compact changed the file", string(v))
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	b, _ := newBackend()
+	b.ChunkSize, b.CompactAfter = 16<<10, 4
+	u := initUsers(t, b, "lee")[0]
+	u.StoreFile("journal", []byte("0"))
+	for i := 1; i < 20; i++ {
+		if err := u.AppendFile("journal", []byte{byte('a' + i)}); err != nil {
+			t.Fatal("AppendFile failed", err)
+		}
+		if n := blockCount(t, u, "journal"); n > 4 {
+			t.Fatal("Block list grew to", n)
+		}
+	}
+	v, _ := u.LoadFile("journal")
+	if len(v) != 20 {
+		t.Error("Wrong content", string(v))
+	}
+
+	// On unless turned off, like DefaultBackend's
+	if n := (Backend{}).compactAfter(); n != DefaultCompactAfter {
+		t.Error("Unset CompactAfter gave", n)
+	}
+	if n := (Backend{CompactAfter: -1}).compactAfter(); n != 0 {
+		t.Error("Negative CompactAfter gave", n)
+	}
+}
+
+// Refuses values over limit bytes, like kvfs-server's -max-value
+type limitedDatastore struct {
+	*userlib.MemDatastore
+	limit int
+}
+
+func (l *limitedDatastore) Set(key string, value []byte) error {
+	if len(value) > l.limit {
+		return errors.New("value too large")
+	}
+	return l.MemDatastore.Set(key, value)
+}
+
+// The block list grows with every append until the store refuses the
+// SharingRecord, unless appends are compacted
+func TestRecordSizeLimit(t *testing.T) {
+	b, mem := newBackend()
+	b.Datastore = &limitedDatastore{MemDatastore: mem, limit: 6 << 10}
+	b.ChunkSize = 4 << 10 // four pieces per merged block
+	b.CompactAfter = -1
+	u := initUsers(t, b, "lee")[0]
+	u.StoreFile("journal", []byte("0"))
+	n := 1
+	for ; n < 1000; n++ {
+		if u.AppendFile("journal", []byte("x")) != nil {
+			break
+		}
+	}
+	if n < 10 || n > 50 {
+		t.Error("Appends failed after", n, "blocks")
+	}
+
+	u.backend.CompactAfter = 10
+	u.StoreFile("journal", []byte("0"))
+	for i := 0; i < 2*n; i++ {
+		if err := u.AppendFile("journal", []byte("x")); err != nil {
+			t.Fatal("AppendFile failed with compaction", i, err)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package assn1
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/fenilfadadu/cs628-assn1/userlib"
+)
+
+// The contents of a directory, stored as the data of its
+// SharingRecord so that it is encrypted, signed and versioned like any
+// file.  Entries point at the Inodes of the children rather than at
+// their SharingRecords, so that revoking a child (which moves its
+// record) only rewrites the child's Inode.
+type directory struct {
+	Entries map[string]dirEntry
+}
+
+// Where a child's Inode is stored and the key sealing it
+type dirEntry struct {
+	InodeAddr string
+	InodeKey  []byte
+}
+
+// The part of an Inode inside a directory that only the directory's
+// writers may read, so that sharing a directory read-only doesn't hand
+// out write access to its files
+type writeSecrets struct {
+	WriteKey userlib.SignKey
+}
+
+// Derives the key sealing the writeSecrets of a directory's children
+// from its write capability
+func dirSecret(dir *Inode) []byte {
+	return hashBytes(append([]byte("directory secrets"),
+		dir.WriteKey...))[:userlib.AESKeySize]
+}
+
+// Derives the key sealing the AccessKey of the shares we received into
+// directories, which nobody else may follow
+func (user *User) receivedSecret() []byte {
+	return hashBytes(append([]byte("received shares"),
+		user.RootKey...))[:userlib.AESKeySize]
+}
+
+// MkDir creates an empty directory.  Its parent must exist already.
+func (user *User) MkDir(path string) (err error) {
+	_, _, err = user.lookup(path)
+	if err == nil {
+		return fmt.Errorf("file %q: %w", path, ErrAlreadyExists)
+	}
+	if !missing(err, path) {
+		return err
+	}
+	site, err := user.linkSite("MkDir", path)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(directory{Entries: map[string]dirEntry{}})
+	if err != nil {
+		return err
+	}
+	file, written, err := user.newFile("MkDir", path, true, data)
+	if err != nil {
+		return err
+	}
+	return user.link(site, file, written)
+}
+
+// ListDir lists a directory, sorted by name.  Like ListFiles it opens
+// every entry, and an entry the caller can't read is listed with its
+// Err set.
+func (user *User) ListDir(path string) ([]FileInfo, error) {
+	_, file, err := user.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	if !file.Dir {
+		return nil, fmt.Errorf("%q: %w", path, ErrNotDir)
+	}
+	_, dir, err := user.loadDir(file)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(dir.Entries))
+	for name := range dir.Entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := []FileInfo{}
+	for _, name := range names {
+		entry := dir.Entries[name]
+		child, err := user.openInode(entry.InodeAddr, entry.InodeKey,
+			path+"/"+name, file)
+		if err != nil {
+			files = append(files, FileInfo{Name: name, Err: err})
+			continue
+		}
+		files = append(files, user.describe(name, child))
+	}
+	return files, nil
+}
+
+// RemoveDir removes an empty directory.  Like DeleteFile it deletes the
+// directory for everybody when the caller owns it, and otherwise only
+// drops it from the caller's namespace.  A directory shared with the
+// caller is dropped whatever it holds, which leaves it as it is for
+// everybody else.
+func (user *User) RemoveDir(path string) (err error) {
+	fileKey, file, err := user.lookup(path)
+	if err != nil {
+		return err
+	}
+	if !file.Dir {
+		return fmt.Errorf("%q: %w", path, ErrNotDir)
+	}
+	if err = user.checkUnlink("RemoveDir", path, file); err != nil {
+		return err
+	}
+	if file.AccessAddr == "" {
+		_, dir, err := user.loadDir(file)
+		if err != nil {
+			return err
+		}
+		if len(dir.Entries) > 0 {
+			return fmt.Errorf("%q: %w", path, ErrNotEmpty)
+		}
+	}
+	return user.remove("RemoveDir", path, fileKey, file)
+}
+
+// Splits a path into its names.  A path without a "/" is a top-level
+// name in the user's namespace.
+func splitPath(path string) ([]string, error) {
+	names := strings.Split(path, "/")
+	for _, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("bad path %q", path)
+		}
+	}
+	return names, nil
+}
+
+// Reports whether err, from looking up path, only says that path itself
+// doesn't exist, so that it can be created
+func missing(err error, path string) bool {
+	var notFound *NotFoundError
+	return errors.As(err, &notFound) && notFound.What == "file" &&
+		notFound.Name == path
+}
+
+// Resolves a path to the Inode it names, file or directory, and the
+// address it is stored at.  The first name is looked up among the
+// user's top-level Inodes, every following one in the directory before
+// it.
+func (user *User) lookup(path string) (fileKey string, file *Inode,
+	err error) {
+	names, err := splitPath(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	fileKey = user.GetInodeKey(names[0])
+	file, err = user.openInode(fileKey, user.RootKey, names[0], nil)
+	for i := 1; err == nil && i < len(names); i++ {
+		if !file.Dir {
+			return "", nil, fmt.Errorf("%q: %w", file.Filename, ErrNotDir)
+		}
+		var dir *directory
+		_, dir, err = user.loadDir(file)
+		if err != nil {
+			return "", nil, err
+		}
+		entry, ok := dir.Entries[names[i]]
+		if !ok {
+			return "", nil, &NotFoundError{What: "file",
+				Name: strings.Join(names[:i+1], "/")}
+		}
+		fileKey = entry.InodeAddr
+		file, err = user.openInode(entry.InodeAddr, entry.InodeKey,
+			strings.Join(names[:i+1], "/"), file)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return fileKey, file, nil
+}
+
+// Where link puts a new name: the address derived from a top-level
+// name, or an entry of a directory as loaded by linkSite
+type linkSite struct {
+	op       string
+	path     string
+	fileKey  string
+	dirInode *Inode
+	shrecord *SharingRecord
+	dir      *directory
+	name     string
+}
+
+// Checks that path is free and that we may create it, before anything
+// is written for the new file
+func (user *User) linkSite(op string, path string) (*linkSite, error) {
+	names, err := splitPath(path)
+	if err != nil {
+		return nil, err
+	}
+	site := &linkSite{op: op, path: path, name: names[len(names)-1]}
+	if len(names) == 1 {
+		site.fileKey = user.GetInodeKey(path)
+		_, status, err := userlib.GetChecked(user.datastore(), site.fileKey)
+		if err != nil {
+			return nil, err
+		} else if status {
+			return nil, fmt.Errorf("file %q: %w", path, ErrAlreadyExists)
+		}
+		return site, nil
+	}
+
+	parent := strings.Join(names[:len(names)-1], "/")
+	_, site.dirInode, err = user.lookup(parent)
+	if err != nil {
+		return nil, err
+	}
+	if !site.dirInode.Dir {
+		return nil, fmt.Errorf("%q: %w", parent, ErrNotDir)
+	}
+	site.shrecord, site.dir, err = user.loadDir(site.dirInode)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := site.dir.Entries[site.name]; ok {
+		return nil, fmt.Errorf("file %q: %w", path, ErrAlreadyExists)
+	}
+	if site.dirInode.WriteKey == nil {
+		return nil, &PermissionError{Op: op, Name: parent,
+			Reason: "read-only share"}
+	}
+	return site, nil
+}
+
+// Gives file the name checked by linkSite.  A top-level name gets its
+// Inode stored at the address derived from it; inside a directory the
+// Inode goes to a fresh address that is then added to the directory.
+// Storing the Inode, respectively the directory, is the commit point.
+// written lists what the caller already wrote for file, left behind if
+// linking fails.
+func (user *User) link(site *linkSite, file *Inode, written []string) error {
+	fail := func(err error) error {
+		if err == nil || len(written) == 0 {
+			return err
+		}
+		return &WriteError{Op: site.op, Leftover: written, Err: err}
+	}
+	file.Filename = site.path
+
+	if site.dirInode == nil {
+		if err := user.indexFile(site.path); err != nil {
+			return fail(err)
+		}
+		file.key, file.parent = user.RootKey, nil
+		return fail(user.storeInode(site.fileKey, file))
+	}
+
+	entry := dirEntry{InodeAddr: newAddress(), InodeKey: newSymmKey()}
+	file.key, file.parent = entry.InodeKey, site.dirInode
+	if err := user.storeInode(entry.InodeAddr, file); err != nil {
+		return fail(err)
+	}
+	written = append(written, entry.InodeAddr)
+	site.dir.Entries[site.name] = entry
+	return fail(user.storeDir(site.op, site.dirInode, site.shrecord,
+		site.dir))
+}
+
+// Checks that the caller may take file out of its directory: a shared
+// directory holds the files of all its writers, and only the owner of
+// one (or whoever received a share into it) may move or drop it.
+// Anybody else would take it away from its owner too.
+func (user *User) checkUnlink(op string, path string, file *Inode) error {
+	if file.parent != nil && file.AccessAddr == "" &&
+		file.Owner != user.Username {
+		return &PermissionError{Op: op, Name: path,
+			Reason: "owned by " + file.Owner}
+	}
+	return nil
+}
+
+// Takes the name path, whose Inode is stored at fileKey, out of the
+// caller's namespace.  Deleting the Inode (for a top-level name) or
+// storing the directory without it is the commit point.  An empty
+// fileKey takes out whatever the name points to, for an Inode that
+// can't be opened anymore.
+func (user *User) unlink(op string, path string, fileKey string) error {
+	names, err := splitPath(path)
+	if err != nil {
+		return err
+	}
+	if len(names) == 1 {
+		if fileKey == "" {
+			fileKey = user.GetInodeKey(path)
+			_, status, err := userlib.GetChecked(user.datastore(), fileKey)
+			if err != nil {
+				return err
+			} else if !status {
+				return &NotFoundError{What: "file", Name: path}
+			}
+		}
+		if err = user.datastore().Delete(fileKey); err != nil {
+			return err
+		}
+		return user.unindexFile(op, path)
+	}
+
+	parent := strings.Join(names[:len(names)-1], "/")
+	name := names[len(names)-1]
+	_, dirInode, err := user.lookup(parent)
+	if err != nil {
+		return err
+	}
+	shrecord, dir, err := user.loadDir(dirInode)
+	if err != nil {
+		return err
+	}
+	entry, ok := dir.Entries[name]
+	if !ok || fileKey != "" && entry.InodeAddr != fileKey {
+		return &NotFoundError{What: "file", Name: path}
+	}
+	delete(dir.Entries, name)
+	if err = user.storeDir(op, dirInode, shrecord, dir); err != nil {
+		return err
+	}
+	return user.deleteGarbage(op, []string{entry.InodeAddr})
+}
+
+// Whether err says that an Inode is gone or corrupt, rather than that
+// it couldn't be fetched or opened by us
+func brokenInode(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrIntegrity)
+}
+
+// Retrieves a directory's SharingRecord and reads the directory from
+// its blocks
+func (user *User) loadDir(file *Inode) (*SharingRecord, *directory,
+	error) {
+	shrecord, err := user.loadSharingRecord(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, err := user.readDir(shrecord)
+	if err != nil {
+		return nil, nil, err
+	}
+	return shrecord, dir, nil
+}
+
+// Reads a directory from the blocks of its SharingRecord
+func (user *User) readDir(shrecord *SharingRecord) (*directory, error) {
+	data, err := io.ReadAll(&fileReader{user: user, shrecord: shrecord})
+	if err != nil {
+		return nil, err
+	}
+	dir := &directory{}
+	if err = json.Unmarshal(data, dir); err != nil {
+		return nil, integrityError(StructDirectory, "unmarshalling failed")
+	}
+	if dir.Entries == nil {
+		dir.Entries = map[string]dirEntry{}
+	}
+	return dir, nil
+}
+
+// Replaces the contents of a directory, see rewrite
+func (user *User) storeDir(op string, file *Inode, shrecord *SharingRecord,
+	dir *directory) error {
+	data, err := json.Marshal(dir)
+	if err != nil {
+		return err
+	}
+	return user.rewrite(op, file, shrecord, data)
+}
+
+// Moves the entries of a directory being rekeyed from old to file.
+// Whoever could read the directory knows where its children's Inodes
+// are, so every child gets a new address and key, and its writeSecrets
+// are sealed under the new write capability.  The children we own are
+// rekeyed as well, keeping their own collaborators.  Files owned by
+// others, and shares received into the directory, keep their records,
+// since only their owners can sign new ones: revoked users who could
+// read them still can, and revoked writers can still write them, until
+// their owners revoke them too.  Returns the moved directory, what was
+// written and the old values to delete.
+func (user *User) rekeyEntries(op string, old *Inode, file *Inode,
+	shrecord *SharingRecord) (data []byte, written []string,
+	garbage []string, err error) {
+	dir, err := user.readDir(shrecord)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	moved := directory{Entries: map[string]dirEntry{}}
+	for name, entry := range dir.Entries {
+		// Shares others received are moved without being opened
+		child, err := user.readInode(entry.InodeAddr, entry.InodeKey,
+			file.Filename+"/"+name, old)
+		var record *SharingRecord
+		if err == nil && child.AccessAddr == "" &&
+			child.Owner == user.Username {
+			record, err = user.loadSharingRecord(child)
+		}
+		if brokenInode(err) {
+			// Dropped, or anybody who can break an Inode could keep
+			// the directory from ever being revoked
+			garbage = append(garbage, entry.InodeAddr)
+			continue
+		} else if err != nil {
+			return nil, written, nil, err
+		}
+		next := dirEntry{InodeAddr: newAddress(), InodeKey: newSymmKey()}
+		child.key, child.parent = next.InodeKey, file
+		if record != nil {
+			previous, err := user.rekeyRecord(op, next.InodeAddr, child,
+				record, user.verifiedGrants(record))
+			if err != nil {
+				return nil, written, nil, err
+			}
+			garbage = append(garbage, previous...)
+		} else if err = user.storeInode(next.InodeAddr, child); err != nil {
+			return nil, written, nil, err
+		}
+		written = append(written, next.InodeAddr)
+		garbage = append(garbage, entry.InodeAddr)
+		moved.Entries[name] = next
+	}
+
+	data, err = json.Marshal(moved)
+	return data, written, garbage, err
+}
@@ -0,0 +1,389 @@
+package assn1
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDirectories(t *testing.T) {
+	b, ds := newBackend()
+	b.ChunkSize = 16
+	alice := initUsers(t, b, "alice")[0]
+	alice.StoreFile("top", []byte("top"))
+	before := len(ds.Keys())
+
+	for _, path := range []string{"docs", "docs/sub"} {
+		if err := alice.MkDir(path); err != nil {
+			t.Fatal("MkDir failed", path, err)
+		}
+	}
+	files := map[string]string{
+		"docs/a":       "0123456789abcdef0123",
+		"docs/sub/b":   "bb",
+		"docs/sub/c":   "c",
+		"docs/sub/tmp": "",
+	}
+	for path, data := range files {
+		if err := alice.StoreFile(path, []byte(data)); err != nil {
+			t.Fatal("StoreFile failed", path, err)
+		}
+	}
+	alice.AppendFile("docs/sub/b", []byte("+"))
+	files["docs/sub/b"] += "+"
+	for path, data := range files {
+		if v, err := alice.LoadFile(path); err != nil || string(v) != data {
+			t.Error("LoadFile gave the wrong contents", path, string(v), err)
+		}
+	}
+
+	list, err := alice.ListDir("docs")
+	want := []FileInfo{
+		{Name: "a", Size: 20, Owner: "alice", Owned: true},
+		{Name: "sub", Owner: "alice", Owned: true, Dir: true},
+	}
+	if err != nil || !reflect.DeepEqual(list, want) {
+		t.Error("Wrong listing", list, err)
+	}
+	if list := listing(t, alice); len(list) != 2 || !list[0].Dir {
+		t.Error("ListFiles doesn't show the directory", list)
+	}
+
+	// Mistakes
+	if err := alice.StoreFile("nodir/x", nil); !errors.Is(err, ErrNotFound) {
+		t.Error("Stored into a missing directory", err)
+	}
+	if err := alice.MkDir("docs/sub"); !errors.Is(err, ErrAlreadyExists) {
+		t.Error("Expected ErrAlreadyExists, got", err)
+	}
+	if _, err := alice.LoadFile("docs"); !errors.Is(err, ErrIsDir) {
+		t.Error("Expected ErrIsDir, got", err)
+	}
+	if err := alice.DeleteFile("docs/sub"); !errors.Is(err, ErrIsDir) {
+		t.Error("Expected ErrIsDir, got", err)
+	}
+	if _, err := alice.ListDir("docs/a"); !errors.Is(err, ErrNotDir) {
+		t.Error("Expected ErrNotDir, got", err)
+	}
+	if _, err := alice.LoadFile("docs/a/x"); !errors.Is(err, ErrNotDir) {
+		t.Error("Expected ErrNotDir, got", err)
+	}
+	if err := alice.RemoveDir("docs"); !errors.Is(err, ErrNotEmpty) {
+		t.Error("Expected ErrNotEmpty, got", err)
+	}
+	if err := alice.StoreFile("docs//a", nil); err == nil {
+		t.Error("Accepted an empty name")
+	}
+	if err := alice.RenameFile("docs", "docs/sub/docs"); err == nil {
+		t.Error("Moved a directory into itself")
+	}
+
+	// Moving things around keeps their contents
+	if err := alice.RenameFile("docs/sub", "sub"); err != nil {
+		t.Fatal("Renaming a directory failed", err)
+	}
+	if err := alice.RenameFile("docs/a", "sub/a"); err != nil {
+		t.Fatal("Moving a file failed", err)
+	}
+	if v, err := alice.LoadFile("sub/b"); err != nil || string(v) != "bb+" {
+		t.Error("Moved directory lost its contents", string(v), err)
+	}
+	if v, err := alice.LoadFile("sub/a"); err != nil || string(v) != files["docs/a"] {
+		t.Error("Moved file lost its contents", string(v), err)
+	}
+	if _, err := alice.LoadFile("docs/sub/b"); !errors.Is(err, ErrNotFound) {
+		t.Error("Old path still loads", err)
+	}
+
+	// Removing everything leaves nothing behind
+	for _, path := range []string{"sub/a", "sub/b", "sub/c", "sub/tmp"} {
+		if err := alice.DeleteFile(path); err != nil {
+			t.Error("DeleteFile failed", path, err)
+		}
+	}
+	for _, path := range []string{"sub", "docs"} {
+		if err := alice.RemoveDir(path); err != nil {
+			t.Error("RemoveDir failed", path, err)
+		}
+	}
+	if n := len(ds.Keys()); n != before {
+		t.Error("Directories left values behind", n-before)
+	}
+}
+
+func TestDirectoryShares(t *testing.T) {
+	b, ds := newBackend()
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+	alice.MkDir("project")
+	alice.StoreFile("project/plan", []byte("plan"))
+	bob.MkDir("inbox")
+
+	// Files in directories are shared, received and revoked by path
+	msgid, err := alice.ShareFile("project/plan", "bob")
+	if err != nil {
+		t.Fatal("ShareFile failed", err)
+	}
+	if err = bob.ReceiveFile("inbox/plan", "alice", msgid); err != nil {
+		t.Fatal("ReceiveFile failed", err)
+	}
+	bob.AppendFile("inbox/plan", []byte("+bob"))
+	if v, _ := alice.LoadFile("project/plan"); string(v) != "plan+bob" {
+		t.Error("bob's append didn't reach alice", string(v))
+	}
+	list, _ := bob.ListDir("inbox")
+	if len(list) != 1 || list[0].Owned || list[0].Owner != "alice" {
+		t.Error("Wrong listing of a shared-in file", list)
+	}
+
+	// Revoking moves the file's record, which only touches its Inode
+	if err = alice.RevokeFile("project/plan"); err != nil {
+		t.Fatal("RevokeFile failed", err)
+	}
+	if v, err := alice.LoadFile("project/plan"); err != nil || string(v) != "plan+bob" {
+		t.Error("alice lost the file", string(v), err)
+	}
+	if _, err := bob.LoadFile("inbox/plan"); err == nil {
+		t.Error("bob kept access")
+	}
+
+	// A tampered directory is caught on the way to its files
+	_, dir, _ := alice.lookup("project")
+	ds.Set(dir.ShRecordAddr, []byte("garbage"))
+	if _, err := alice.LoadFile("project/plan"); !errors.Is(err, ErrIntegrity) {
+		t.Error("Tampered directory not detected", err)
+	}
+}
+
+func TestShareDirectory(t *testing.T) {
+	b, ds := newBackend()
+	u := initUsers(t, b, "alice", "bob", "carol", "dave")
+	alice, bob, carol, dave := u[0], u[1], u[2], u[3]
+	alice.MkDir("proj")
+	alice.MkDir("proj/sub")
+	alice.StoreFile("proj/a", []byte("a"))
+	alice.StoreFile("proj/sub/b", []byte("b"))
+
+	// One msgid mounts the whole tree
+	msgid, err := alice.ShareFile("proj", "bob")
+	if err != nil {
+		t.Fatal("Sharing a directory failed", err)
+	}
+	if err = bob.ReceiveFile("shared", "alice", msgid); err != nil {
+		t.Fatal("Receiving a directory failed", err)
+	}
+	msgid, _ = alice.ShareFileWithMode("proj", "carol", ReadOnly)
+	if err = carol.ReceiveFile("mnt", "alice", msgid); err != nil {
+		t.Fatal("Receiving a read-only directory failed", err)
+	}
+	if v, err := bob.LoadFile("shared/sub/b"); err != nil || string(v) != "b" {
+		t.Error("Mounted tree unreadable", string(v), err)
+	}
+	if list := listing(t, bob); len(list) != 1 || !list[0].Dir || list[0].Owned {
+		t.Error("Wrong listing of a mounted directory", list)
+	}
+
+	// Later changes show up for everybody
+	alice.StoreFile("proj/new", []byte("new"))
+	bob.StoreFile("shared/bobs", []byte("bob's"))
+	bob.AppendFile("shared/a", []byte("+bob"))
+	for _, c := range []struct {
+		u    *User
+		path string
+		want string
+	}{
+		{carol, "mnt/new", "new"},
+		{alice, "proj/bobs", "bob's"},
+		{carol, "mnt/a", "a+bob"},
+	} {
+		if v, err := c.u.LoadFile(c.path); err != nil || string(v) != c.want {
+			t.Error("Change not visible", c.u.Username, c.path, string(v), err)
+		}
+	}
+
+	// Writers can't take alice's files away from her, only move their
+	// own
+	if err := bob.RenameFile("shared/a", "stolen"); !errors.Is(err, ErrPermission) {
+		t.Error("bob could move alice's file", err)
+	}
+	if err := bob.DeleteFile("shared/a"); !errors.Is(err, ErrPermission) {
+		t.Error("bob could delete alice's file", err)
+	}
+	if err := bob.RemoveDir("shared/sub"); !errors.Is(err, ErrPermission) {
+		t.Error("bob could remove alice's directory", err)
+	}
+	if v, err := alice.LoadFile("proj/a"); err != nil || string(v) != "a+bob" {
+		t.Error("alice lost her file", string(v), err)
+	}
+	if err := bob.RenameFile("shared/bobs", "shared/tmp"); err != nil {
+		t.Error("bob couldn't move his own file", err)
+	}
+	bob.RenameFile("shared/tmp", "shared/bobs")
+
+	// Read-only all the way down, and not just in the client: the
+	// Inodes carol can open hold no write key
+	before := len(ds.Keys())
+	for _, path := range []string{"mnt/a", "mnt/sub/b", "mnt/x"} {
+		if err := carol.StoreFile(path, nil); !errors.Is(err, ErrPermission) {
+			t.Error("carol could write", path, err)
+		}
+	}
+	if err := carol.MkDir("mnt/dir"); !errors.Is(err, ErrPermission) {
+		t.Error("carol could create a directory", err)
+	}
+	if err := carol.RenameFile("mnt/a", "a"); !errors.Is(err, ErrPermission) {
+		t.Error("carol could move a file out", err)
+	}
+	if _, err := carol.LoadFile("a"); !errors.Is(err, ErrNotFound) {
+		t.Error("Refused move left a copy", err)
+	}
+	if n := len(ds.Keys()); n != before {
+		t.Error("Refused writes left values behind", n-before)
+	}
+	fileKey, file, _ := carol.lookup("mnt/sub/b")
+	raw, err := carol.openInode(fileKey, file.key, "raw", nil)
+	if err != nil || raw.WriteKey != nil || raw.Sealed == nil {
+		t.Error("Write key stored in the clear", err)
+	}
+
+	// A share received into the directory was granted to bob alone, so
+	// nobody else can follow it, nor pass it on without a grant
+	dave.StoreFile("d", []byte("dave's"))
+	msgid, _ = dave.ShareFileWithMode("d", "bob", ReadOnly)
+	bob.ReceiveFile("shared/d", "dave", msgid)
+	if v, err := bob.LoadFile("shared/d"); err != nil || string(v) != "dave's" {
+		t.Error("bob can't read dave's file", string(v), err)
+	}
+	for _, c := range []struct {
+		u    *User
+		path string
+	}{{alice, "proj/d"}, {carol, "mnt/d"}} {
+		if _, err := c.u.LoadFile(c.path); !errors.Is(err, ErrPermission) {
+			t.Error(c.u.Username, "followed bob's share", err)
+		}
+	}
+	if tree, _ := dave.ListCollaborators("d"); len(tree) != 1 {
+		t.Error("Share handed on without a grant", tree)
+	}
+
+	// Revoking bob moves every file alice owns in the tree, so what bob
+	// learned before is of no use
+	_, old, _ := bob.lookup("shared/sub/b")
+	if err = alice.RevokeUser("proj", "bob"); err != nil {
+		t.Fatal("Revoking a directory failed", err)
+	}
+	if _, err := bob.LoadFile("shared/a"); err == nil {
+		t.Error("bob kept access to the directory")
+	}
+	if _, err := bob.loadSharingRecord(old); err == nil {
+		t.Error("bob kept access to a file in the directory")
+	}
+	for _, c := range []struct {
+		u    *User
+		path string
+		want string
+	}{
+		{alice, "proj/sub/b", "b"},
+		{carol, "mnt/sub/b", "b"},
+		{carol, "mnt/bobs", "bob's"},
+		{alice, "proj/new", "new"},
+	} {
+		if v, err := c.u.LoadFile(c.path); err != nil || string(v) != c.want {
+			t.Error("Revocation broke", c.u.Username, c.path, string(v), err)
+		}
+	}
+	if err := alice.AppendFile("proj/sub/b", []byte("!")); err != nil {
+		t.Error("alice can't write after revoking", err)
+	}
+	if err := carol.AppendFile("mnt/sub/b", []byte("!")); !errors.Is(err, ErrPermission) {
+		t.Error("carol could write after the revocation", err)
+	}
+
+	// Recipients drop a mounted directory whatever it holds
+	if err := carol.RemoveDir("mnt"); err != nil {
+		t.Error("carol couldn't drop the directory", err)
+	}
+	if list, err := alice.ListDir("proj"); err != nil || len(list) != 5 {
+		t.Error("Dropping the share affected alice", list, err)
+	}
+}
+
+// Revoking a directory can't move files that others own in it: they
+// stay open to the revoked users until their owners revoke them too
+func TestRevokeDirectoryOthersFiles(t *testing.T) {
+	b, _ := newBackend()
+	u := initUsers(t, b, "alice", "bob", "carol")
+	alice, bob, carol := u[0], u[1], u[2]
+	alice.MkDir("proj")
+	for _, c := range []*User{bob, carol} {
+		msgid, _ := alice.ShareFile("proj", c.Username)
+		c.ReceiveFile("shared", "alice", msgid)
+	}
+	carol.StoreFile("shared/c", []byte("carol's"))
+
+	_, old, _ := bob.lookup("shared/c")
+	if err := alice.RevokeUser("proj", "bob"); err != nil {
+		t.Fatal("RevokeUser failed", err)
+	}
+	record, err := bob.loadSharingRecord(old)
+	if err != nil || old.WriteKey == nil {
+		t.Fatal("bob lost carol's file already", err)
+	}
+	record.Version++
+	if err = bob.storeSharingRecord(old, record); err != nil {
+		t.Error("bob lost write access to carol's file", err)
+	}
+
+	if err = carol.RevokeFile("shared/c"); err != nil {
+		t.Fatal("RevokeFile failed", err)
+	}
+	if _, err = bob.loadSharingRecord(old); err == nil {
+		t.Error("bob kept access after carol revoked")
+	}
+	for _, c := range []struct {
+		u    *User
+		path string
+	}{{alice, "proj/c"}, {carol, "shared/c"}} {
+		if v, err := c.u.LoadFile(c.path); err != nil || string(v) != "carol's" {
+			t.Error("Revocation broke", c.u.Username, string(v), err)
+		}
+	}
+}
+
+// An entry whose Inode is gone or broken neither blocks a revocation
+// nor stays in the directory for good
+func TestBrokenEntries(t *testing.T) {
+	b, ds := newBackend()
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+	alice.MkDir("proj")
+	for _, name := range []string{"a", "b", "c"} {
+		alice.StoreFile("proj/"+name, []byte(name))
+	}
+	msgid, _ := alice.ShareFile("proj", "bob")
+	bob.ReceiveFile("shared", "alice", msgid)
+
+	fileKey, _, _ := bob.lookup("shared/a")
+	ds.Delete(fileKey)
+	if err := alice.RevokeUser("proj", "bob"); err != nil {
+		t.Fatal("A missing Inode blocked the revocation", err)
+	}
+	if _, err := bob.LoadFile("shared/b"); err == nil {
+		t.Error("bob kept access")
+	}
+	if list, err := alice.ListDir("proj"); err != nil || len(list) != 2 {
+		t.Error("Missing entry not dropped", list, err)
+	}
+
+	fileKey, _, _ = alice.lookup("proj/c")
+	ds.Set(fileKey, []byte("garbage"))
+	if err := alice.DeleteFile("proj/c"); err != nil {
+		t.Error("Couldn't delete a broken entry", err)
+	}
+	if err := alice.DeleteFile("proj/c"); !errors.Is(err, ErrNotFound) {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+	if v, err := alice.LoadFile("proj/b"); err != nil || string(v) != "b" {
+		t.Error("Dropping entries broke the directory", string(v), err)
+	}
+}
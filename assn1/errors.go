@@ -0,0 +1,173 @@
+package assn1
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors returned (possibly wrapped) by the User methods.
+// Test for them with errors.Is; use errors.As with NotFoundError or
+// IntegrityError for the details.
+var (
+	// The user, file or share does not exist (or access was revoked)
+	ErrNotFound = errors.New("not found")
+
+	// Something read back from the Datastore was tampered with
+	ErrIntegrity = errors.New("integrity check failed")
+
+	// The username/password pair does not match a stored user
+	ErrWrongCredentials = errors.New("wrong username or password")
+
+	// The username or filename is already taken
+	ErrAlreadyExists = errors.New("already exists")
+
+	// A failed write left values behind in the Datastore, see WriteError
+	ErrPartialWrite = errors.New("partial write")
+
+	// The caller is not allowed to do this to the file
+	ErrPermission = errors.New("permission denied")
+
+	// The server handed out an older version of a file than it did
+	// before, see FreshnessError
+	ErrRollback = errors.New("rollback detected")
+
+	// The file changed under an operation that had to give up
+	ErrConflict = errors.New("concurrent modification")
+
+	// The server handed out two different histories of a file, see
+	// FreshnessError
+	ErrFork = errors.New("forked history")
+
+	// A file operation was given a directory, or a directory operation
+	// something else
+	ErrIsDir  = errors.New("is a directory")
+	ErrNotDir = errors.New("not a directory")
+
+	// RemoveDir was given a directory that still has entries
+	ErrNotEmpty = errors.New("directory not empty")
+)
+
+// Structures that can fail verification, see IntegrityError
+const (
+	StructUser          = "User"
+	StructInode         = "Inode"
+	StructSharingRecord = "SharingRecord"
+	StructData          = "Data"
+	StructMsgid         = "Msgid"
+	StructIndex         = "Index"
+	StructDirectory     = "Directory"
+)
+
+// NotFoundError reports what could not be found.  It matches
+// ErrNotFound.
+type NotFoundError struct {
+	What string // "user", "file", "recipient", ...
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Name == "" {
+		return e.What + " not found"
+	}
+	return fmt.Sprintf("%s %q not found", e.What, e.Name)
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+// PermissionError reports an operation the caller may not perform on a
+// file.  It matches ErrPermission.
+type PermissionError struct {
+	Op     string
+	Name   string
+	Reason string
+}
+
+func (e *PermissionError) Error() string {
+	return fmt.Sprintf("%s %q: permission denied: %s", e.Op, e.Name, e.Reason)
+}
+
+func (e *PermissionError) Is(target error) bool {
+	return target == ErrPermission
+}
+
+// IntegrityError reports which structure failed verification and why.
+// Block is the index of the failing data block when Structure is
+// StructData, and -1 otherwise.  It matches ErrIntegrity.
+type IntegrityError struct {
+	Structure string
+	Block     int
+	Reason    string
+}
+
+func (e *IntegrityError) Error() string {
+	if e.Block >= 0 {
+		return fmt.Sprintf("%s block %d: %s", e.Structure, e.Block, e.Reason)
+	}
+	return fmt.Sprintf("%s: %s", e.Structure, e.Reason)
+}
+
+func (e *IntegrityError) Is(target error) bool {
+	return target == ErrIntegrity
+}
+
+// Shorthand for failures of anything but a data block
+func integrityError(structure string, reason string) error {
+	return &IntegrityError{Structure: structure, Block: -1, Reason: reason}
+}
+
+// FreshnessError reports a SharingRecord that doesn't follow the newest
+// version this session saw of the file: an older one (a rollback) or
+// a different one at or right after the same version (a fork).  It
+// matches ErrIntegrity and either ErrRollback or ErrFork.
+type FreshnessError struct {
+	Name string
+	Seen uint64 // newest version seen before
+	Got  uint64
+	Fork bool
+}
+
+func (e *FreshnessError) Error() string {
+	what := "rolled back"
+	if e.Fork {
+		what = "forked"
+	}
+	return fmt.Sprintf("file %q %s: saw version %d, got version %d",
+		e.Name, what, e.Seen, e.Got)
+}
+
+func (e *FreshnessError) Is(target error) bool {
+	if e.Fork {
+		return target == ErrFork || target == ErrIntegrity
+	}
+	return target == ErrRollback || target == ErrIntegrity
+}
+
+// WriteError reports a Datastore write that failed in the middle of an
+// operation.  Unless Committed is set the file is unchanged; Leftover
+// lists the keys that were written (or should have been deleted) and
+// now hold unreferenced values.
+type WriteError struct {
+	Op        string
+	Committed bool
+	Leftover  []string
+	Err       error
+}
+
+func (e *WriteError) Error() string {
+	state := "not committed"
+	if e.Committed {
+		state = "committed, cleanup failed"
+	}
+	return fmt.Sprintf("%s: write %s (%d values left behind): %v",
+		e.Op, state, len(e.Leftover), e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+func (e *WriteError) Is(target error) bool {
+	return target == ErrPartialWrite && len(e.Leftover) > 0
+}
@@ -0,0 +1,136 @@
+package assn1
+
+import (
+	"errors"
+	"sort"
+)
+
+// FileInfo describes one file in the caller's namespace, see ListFiles
+type FileInfo struct {
+	Name  string
+	Size  int
+	Owner string
+
+	// False for files shared with us
+	Owned bool
+
+	// Set for directories, whose Size is 0
+	Dir bool
+
+	// Why the file can't be read (e.g. our access was revoked), in
+	// which case Size is 0
+	Err error
+}
+
+// The names in a user's namespace, sealed under the user's IndexKey at
+// IndexAddr.  Names are added before the Inode is written and removed
+// after it is deleted, so the index may list a name that has no Inode
+// but never misses one that has.
+type fileIndex struct {
+	Names []string // sorted
+}
+
+// ListFiles lists the top-level files and directories in the caller's
+// namespace, sorted by name.
+// Every file is opened to report its size, so a file the caller can no
+// longer read is listed with its Err set rather than failing the call.
+//
+// Files stored before the index was introduced are not listed.
+func (user *User) ListFiles() ([]FileInfo, error) {
+	index, err := user.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	files := []FileInfo{}
+	for _, name := range index.Names {
+		_, file, err := user.lookup(name)
+		if errors.Is(err, ErrNotFound) {
+			// Left over by an operation that didn't complete
+			continue
+		}
+		if err != nil {
+			files = append(files, FileInfo{Name: name, Err: err})
+			continue
+		}
+		files = append(files, user.describe(name, file))
+	}
+	return files, nil
+}
+
+// Describes the file or directory behind an Inode, listed as name
+func (user *User) describe(name string, file *Inode) FileInfo {
+	info := FileInfo{
+		Name:  name,
+		Owner: file.Owner,
+		Owned: file.AccessAddr == "" && file.Owner == user.Username,
+		Dir:   file.Dir,
+	}
+	if file.Dir {
+		_, _, info.Err = user.loadDir(file)
+		return info
+	}
+	shrecord, err := user.loadSharingRecord(file)
+	if err != nil {
+		info.Err = err
+	} else {
+		info.Size = shrecord.size()
+	}
+	return info
+}
+
+// Retrieves and opens the caller's index.  A user without one has no
+// files yet.
+func (user *User) loadIndex() (*fileIndex, error) {
+	index := &fileIndex{}
+	status, err := loadSealed(user.datastore(), user.IndexAddr,
+		user.IndexKey, index)
+	if !status && err != nil {
+		return nil, err
+	} else if !status {
+		return &fileIndex{}, nil
+	}
+	if err != nil {
+		return nil, integrityError(StructIndex, err.Error())
+	}
+	if !sort.StringsAreSorted(index.Names) {
+		return nil, integrityError(StructIndex, "names out of order")
+	}
+	return index, nil
+}
+
+// Adds name to the caller's index.  It comes before the Inode is
+// written, so on failure nothing has changed.
+func (user *User) indexFile(name string) error {
+	index, err := user.loadIndex()
+	if err != nil {
+		return err
+	}
+	i := sort.SearchStrings(index.Names, name)
+	if i < len(index.Names) && index.Names[i] == name {
+		return nil
+	}
+	index.Names = append(index.Names, "")
+	copy(index.Names[i+1:], index.Names[i:])
+	index.Names[i] = name
+	return storeSealed(user.datastore(), user.IndexAddr, user.IndexKey, index)
+}
+
+// Removes name from the caller's index once op committed deleting its
+// Inode
+func (user *User) unindexFile(op string, name string) error {
+	index, err := user.loadIndex()
+	if err == nil {
+		i := sort.SearchStrings(index.Names, name)
+		if i == len(index.Names) || index.Names[i] != name {
+			return nil
+		}
+		index.Names = append(index.Names[:i], index.Names[i+1:]...)
+		err = storeSealed(user.datastore(), user.IndexAddr,
+			user.IndexKey, index)
+	}
+	if err != nil {
+		return &WriteError{Op: op, Committed: true, Err: err}
+	}
+	return nil
+}
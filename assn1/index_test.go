@@ -0,0 +1,118 @@
+package assn1
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// The files listed, with Err only telling whether there was one
+func listing(t *testing.T, u *User) []FileInfo {
+	t.Helper()
+	files, err := u.ListFiles()
+	if err != nil {
+		t.Fatal("ListFiles failed", err)
+	}
+	for i := range files {
+		if files[i].Err != nil {
+			files[i].Err = ErrNotFound
+		}
+	}
+	return files
+}
+
+func TestListFiles(t *testing.T) {
+	b, ds := newBackend()
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+
+	if files := listing(t, alice); len(files) != 0 {
+		t.Error("New user has files", files)
+	}
+
+	alice.StoreFile("notes", []byte("0123456789"))
+	alice.StoreFile("draft", []byte("abc"))
+	alice.StoreFile("draft", []byte("abcd"))
+	bob.StoreFile("todo", []byte("xy"))
+	msgid, _ := bob.ShareFile("todo", "alice")
+	alice.ReceiveFile("bobs-todo", "bob", msgid)
+	alice.RenameFile("notes", "journal")
+
+	want := []FileInfo{
+		{Name: "bobs-todo", Size: 2, Owner: "bob"},
+		{Name: "draft", Size: 4, Owner: "alice", Owned: true},
+		{Name: "journal", Size: 10, Owner: "alice", Owned: true},
+	}
+	if files := listing(t, alice); !reflect.DeepEqual(files, want) {
+		t.Error("Wrong listing", files)
+	}
+
+	// A revoked share stays listed until it is deleted
+	bob.RevokeFile("todo")
+	want[0] = FileInfo{Name: "bobs-todo", Owner: "bob", Err: ErrNotFound}
+	if files := listing(t, alice); !reflect.DeepEqual(files, want) {
+		t.Error("Wrong listing after revocation", files)
+	}
+	alice.DeleteFile("bobs-todo")
+	alice.DeleteFile("draft")
+	if files := listing(t, alice); !reflect.DeepEqual(files, want[2:]) {
+		t.Error("Wrong listing after deletions", files)
+	}
+
+	// A name whose Inode is gone is skipped
+	alice.indexFile("ghost")
+	if files := listing(t, alice); !reflect.DeepEqual(files, want[2:]) {
+		t.Error("Listed a file without an Inode", files)
+	}
+
+	// The index is tied to its owner and address
+	ds.Set(alice.IndexAddr, []byte("garbage"))
+	if _, err := alice.ListFiles(); !errors.Is(err, ErrIntegrity) {
+		t.Error("Tampered index not detected", err)
+	}
+	if err := alice.StoreFile("new", nil); !errors.Is(err, ErrIntegrity) {
+		t.Error("StoreFile ignored a tampered index", err)
+	}
+	bob.StoreFile("other", nil)
+	sealed, _ := ds.Get(bob.IndexAddr)
+	ds.Set(alice.IndexAddr, sealed)
+	if _, err := alice.ListFiles(); !errors.Is(err, ErrIntegrity) {
+		t.Error("Swapped index not detected", err)
+	}
+}
+
+func TestIndexUpgrade(t *testing.T) {
+	b, _ := newBackend()
+	alice := initUsers(t, b, "alice")[0]
+
+	// A User stored and a session saved before there was an index
+	old := *alice
+	old.IndexAddr, old.IndexKey = "", nil
+	err := storeSealed(b.Datastore, GetUserKey("alice", "alicepass"),
+		getUserSymKey("alice", "alicepass"), &old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _ := old.Session()
+
+	u, err := b.GetUser("alice", "alicepass")
+	if err != nil {
+		t.Fatal("GetUser failed", err)
+	}
+	if u.IndexAddr == "" || u.IndexAddr == alice.IndexAddr {
+		t.Fatal("GetUser didn't create an index", u.IndexAddr)
+	}
+	u.StoreFile("file", []byte("data"))
+
+	// Everybody else finds the same index
+	again, _ := b.GetUser("alice", "alicepass")
+	resumed, err := b.ResumeSession(session)
+	if err != nil {
+		t.Fatal("ResumeSession failed", err)
+	}
+	for _, v := range []*User{again, resumed} {
+		if files := listing(t, v); len(files) != 1 || files[0].Name != "file" {
+			t.Error("Index not shared", files)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package assn1
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errClosed = errors.New("file already closed")
+
+// OpenReader opens a file for reading.  Blocks are fetched, verified
+// and decrypted one at a time as the reader gets to them, so the file
+// is never held in memory as a whole.  The reader sees the file as it
+// was when it was opened, unless a later write deletes blocks it has
+// yet to read: Read then fails with ErrConflict.
+func (user *User) OpenReader(filename string) (io.ReadCloser, error) {
+	_, file, err := user.loadInode(filename)
+	if err != nil {
+		return nil, err
+	}
+	shrecord, err := user.loadSharingRecord(file)
+	if err != nil {
+		return nil, err
+	}
+	return &fileReader{user: user, filename: filename, shrecord: shrecord},
+		nil
+}
+
+type fileReader struct {
+	user     *User
+	filename string
+	shrecord *SharingRecord
+	next     int    // next block to load
+	buf      []byte // what is left of the current block
+	closed   bool
+}
+
+func (r *fileReader) Read(p []byte) (n int, err error) {
+	if r.closed {
+		return 0, errClosed
+	}
+	for len(r.buf) == 0 {
+		if r.next == len(r.shrecord.Address) {
+			return 0, io.EOF
+		}
+		block, err := r.user.loadBlock(r.shrecord, r.next)
+		if err != nil {
+			return 0, r.user.blockGone(r.filename, r.shrecord, err)
+		}
+		r.buf = block.Value
+		r.next++
+	}
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *fileReader) Close() error {
+	if r.closed {
+		return errClosed
+	}
+	r.closed, r.buf = true, nil
+	return nil
+}
+
+// ReadAt reads up to length bytes of a file starting at offset.  Only
+// the blocks overlapping the range are fetched, found through the
+// block lengths kept in the SharingRecord.  Fewer bytes are returned
+// when the file ends first; an offset at or past the end gives io.EOF.
+func (user *User) ReadAt(filename string, offset int,
+	length int) (data []byte, err error) {
+	if offset < 0 || length < 0 {
+		return nil, errors.New("negative offset or length")
+	}
+	_, file, err := user.loadInode(filename)
+	if err != nil {
+		return nil, err
+	}
+	shrecord, err := user.loadSharingRecord(file)
+	if err != nil {
+		return nil, err
+	}
+	if offset >= shrecord.size() {
+		if length == 0 {
+			return []byte{}, nil
+		}
+		return nil, io.EOF
+	}
+
+	// Clamped before adding, so a huge length can't overflow
+	if size := shrecord.size(); length > size-offset {
+		length = size - offset
+	}
+	end := offset + length
+	data = make([]byte, 0, length)
+	start := 0 // of block i
+	for i, n := range shrecord.Lengths {
+		if start >= end {
+			break
+		}
+		if start+n > offset {
+			block, err := user.loadBlock(shrecord, i)
+			if err != nil {
+				return nil, user.blockGone(filename, shrecord, err)
+			}
+			lo, hi := offset-start, end-start
+			if lo < 0 {
+				lo = 0
+			}
+			if hi > n {
+				hi = n
+			}
+			data = append(data, block.Value[lo:hi]...)
+		}
+		start += n
+	}
+	return data, nil
+}
+
+// WriteAt overwrites a file with data starting at offset, growing it
+// if data runs past the end.  Only the blocks overlapping the range are
+// replaced (by new blocks at new addresses under new keys); the rest of
+// the file is untouched.  What the range leaves of those blocks keeps
+// its authors: their signed pieces are kept, trimmed, in blocks of
+// their own.  offset may be at most the size of the file.
+func (user *User) WriteAt(filename string, offset int, data []byte) (err error) {
+	if offset < 0 {
+		return errors.New("negative offset")
+	}
+	_, file, err := user.loadInode(filename)
+	if err != nil {
+		return err
+	}
+	shrecord, err := user.loadSharingRecord(file)
+	if err != nil {
+		return err
+	}
+	if file.WriteKey == nil {
+		return &PermissionError{Op: "WriteAt", Name: filename,
+			Reason: "read-only share"}
+	}
+	if offset > shrecord.size() {
+		return fmt.Errorf("offset %d past the end of %q", offset, filename)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	// Blocks first to last (exclusive) overlap the range and start at
+	// byte start of the file
+	end := offset + len(data)
+	first, last, start := 0, 0, 0
+	for pos := 0; last < len(shrecord.Lengths) && pos < end; last++ {
+		if pos+shrecord.Lengths[last] <= offset {
+			first, start = last+1, pos+shrecord.Lengths[last]
+		}
+		pos += shrecord.Lengths[last]
+	}
+
+	// Keep what the range doesn't cover of the first and last block
+	var head, tail []Data
+	if first < last && offset > start {
+		block, err := user.loadBlock(shrecord, first)
+		if err != nil {
+			return user.blockGone(filename, shrecord, err)
+		}
+		head = trimPieces(block.pieces(), 0, offset-start)
+	}
+	blocksEnd := start + sumLengths(shrecord.Lengths[first:last])
+	if end < blocksEnd {
+		block, err := user.loadBlock(shrecord, last-1)
+		if err != nil {
+			return user.blockGone(filename, shrecord, err)
+		}
+		n := len(block.Value)
+		tail = trimPieces(block.pieces(), n-(blocksEnd-end), n)
+	}
+
+	blocks := blockList{fileID: shrecord.FileID}
+	if err = user.storeKept("WriteAt", &blocks, head); err != nil {
+		return err
+	}
+	if err = user.storeChunks("WriteAt", &blocks, data); err != nil {
+		return err
+	}
+	if err = user.storeKept("WriteAt", &blocks, tail); err != nil {
+		return err
+	}
+
+	// Splice the new blocks in place of the old ones
+	garbage := append([]string(nil), shrecord.Address[first:last]...)
+	updated := *shrecord
+	updated.Address, updated.SymmKey = nil, nil
+	updated.Hashes, updated.Lengths = nil, nil
+	(&blockList{
+		address: shrecord.Address[:first],
+		symmKey: shrecord.SymmKey[:first],
+		hashes:  shrecord.Hashes[:first],
+		lengths: shrecord.Lengths[:first],
+	}).appendTo(&updated)
+	blocks.appendTo(&updated)
+	(&blockList{
+		address: shrecord.Address[last:],
+		symmKey: shrecord.SymmKey[last:],
+		hashes:  shrecord.Hashes[last:],
+		lengths: shrecord.Lengths[last:],
+	}).appendTo(&updated)
+
+	// The SharingRecord is the commit point
+	err = user.storeSharingRecord(file, &updated)
+	if err != nil {
+		return &WriteError{Op: "WriteAt", Leftover: blocks.address, Err: err}
+	}
+	return user.deleteGarbage("WriteAt", garbage)
+}
+
+// OpenAppender opens a file for appending.  Written data is encrypted
+// and uploaded a chunk at a time; nothing becomes visible until Close
+// adds the blocks to the SharingRecord, so an appender that is never
+// closed leaves the file unchanged.
+func (user *User) OpenAppender(filename string) (io.WriteCloser, error) {
+	_, file, err := user.loadInode(filename)
+	if err != nil {
+		return nil, err
+	}
+	shrecord, err := user.loadSharingRecord(file)
+	if err != nil {
+		return nil, err
+	}
+	if file.WriteKey == nil {
+		return nil, &PermissionError{Op: "OpenAppender", Name: filename,
+			Reason: "read-only share"}
+	}
+	return &fileAppender{user: user, filename: filename,
+		blocks: blockList{fileID: shrecord.FileID}}, nil
+}
+
+type fileAppender struct {
+	user     *User
+	filename string
+	buf      []byte
+	blocks   blockList // uploaded so far, signed for the file opened
+	closed   bool
+}
+
+func (a *fileAppender) Write(p []byte) (n int, err error) {
+	if a.closed {
+		return 0, errClosed
+	}
+	size := a.user.backend.chunkSize()
+	a.buf = append(a.buf, p...)
+	for len(a.buf) >= size {
+		err = a.user.storeChunk("OpenAppender", &a.blocks, a.buf[:size])
+		if err != nil {
+			return 0, err
+		}
+		a.buf = a.buf[size:]
+	}
+	return len(p), nil
+}
+
+// Close uploads what is left and commits the blocks.  The record is
+// loaded again so that whatever collaborators did in the meantime is
+// kept.  If the name now refers to another file, the blocks (signed
+// for the one opened) are dropped with ErrConflict.
+func (a *fileAppender) Close() error {
+	if a.closed {
+		return errClosed
+	}
+	a.closed = true
+	if len(a.buf) > 0 {
+		err := a.user.storeChunk("OpenAppender", &a.blocks, a.buf)
+		if err != nil {
+			return err
+		}
+		a.buf = nil
+	}
+	if len(a.blocks.address) == 0 {
+		return nil
+	}
+
+	_, file, err := a.user.loadInode(a.filename)
+	if err == nil {
+		var shrecord *SharingRecord
+		shrecord, err = a.user.loadSharingRecord(file)
+		if err == nil && shrecord.FileID != a.blocks.fileID {
+			err = fmt.Errorf("OpenAppender %q: %w", a.filename, ErrConflict)
+		}
+		if err == nil {
+			before := len(shrecord.Address)
+			a.blocks.appendTo(shrecord)
+			err = a.user.storeSharingRecord(file, shrecord)
+			if err == nil {
+				a.user.autoCompact(a.filename, before,
+					len(shrecord.Address))
+			}
+		}
+	}
+	if err != nil {
+		return &WriteError{Op: "OpenAppender",
+			Leftover: a.blocks.address, Err: err}
+	}
+	return nil
+}
+
+// The pieces of a block, trimmed to bytes lo..hi of its content
+func trimPieces(pieces []Data, lo int, hi int) []Data {
+	var kept []Data
+	pos := 0 // where the content of piece starts in the block
+	for _, piece := range pieces {
+		n := len(piece.content())
+		if pos < hi && pos+n > lo {
+			if lo > pos {
+				piece.Skip += lo - pos
+			}
+			if pos+n > hi {
+				piece.Drop += pos + n - hi
+			}
+			kept = append(kept, piece)
+		}
+		pos += n
+	}
+	return kept
+}
+
+// Stores pieces kept from replaced blocks as one merged block, still
+// signed by their authors, and adds it to the list
+func (user *User) storeKept(op string, blocks *blockList,
+	pieces []Data) error {
+	if len(pieces) == 0 {
+		return nil
+	}
+	address, dbkey := newAddress(), newSymmKey()
+	hash, err := user.storeData(address, dbkey, &Data{Merged: pieces})
+	if err != nil {
+		return &WriteError{Op: op, Leftover: blocks.address, Err: err}
+	}
+	length := 0
+	for _, piece := range pieces {
+		length += len(piece.content())
+	}
+	blocks.add(address, dbkey, hash, length)
+	return nil
+}
@@ -0,0 +1,249 @@
+package assn1
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/fenilfadadu/cs628-assn1/userlib"
+)
+
+func TestStreams(t *testing.T) {
+	b, _ := newBackend()
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+
+	alice.StoreFile("artifact", []byte("head:"))
+	msgid, _ := alice.ShareFileWithMode("artifact", "bob", ReadOnly)
+	bob.ReceiveFile("artifact", "alice", msgid)
+
+	// Two and a half blocks, written in odd sized pieces
+	payload := bytes.Repeat([]byte("0123456789abcdef"), DefaultChunkSize*5/32)
+	w, err := alice.OpenAppender("artifact")
+	if err != nil {
+		t.Fatal("OpenAppender failed", err)
+	}
+	if _, err = io.CopyBuffer(w, bytes.NewReader(payload),
+		make([]byte, 1000)); err != nil {
+		t.Fatal("Write failed", err)
+	}
+
+	// Nothing shows before Close, and collaborators' appends survive it
+	if v, _ := bob.LoadFile("artifact"); string(v) != "head:" {
+		t.Error("Appended blocks visible before Close", len(v))
+	}
+	alice.AppendFile("artifact", []byte("mid:"))
+	if err = w.Close(); err != nil {
+		t.Fatal("Close failed", err)
+	}
+	if _, err = w.Write([]byte("late")); err == nil {
+		t.Error("Wrote to a closed appender")
+	}
+
+	_, file, _ := bob.loadInode("artifact")
+	shrecord, _ := bob.loadSharingRecord(file)
+	if len(shrecord.Address) != 5 {
+		t.Error("Expected 5 blocks, got", len(shrecord.Address))
+	}
+
+	r, err := bob.OpenReader("artifact")
+	if err != nil {
+		t.Fatal("OpenReader failed", err)
+	}
+	v, err := io.ReadAll(r)
+	want := append([]byte("head:mid:"), payload...)
+	if err != nil || !bytes.Equal(v, want) {
+		t.Error("Read back the wrong data", len(v), err)
+	}
+	r.Close()
+	if _, err = r.Read(make([]byte, 1)); err == nil {
+		t.Error("Read from a closed reader")
+	}
+
+	if _, err = bob.OpenAppender("artifact"); !errors.Is(err, ErrPermission) {
+		t.Error("Expected ErrPermission, got", err)
+	}
+	if _, err = bob.OpenReader("missing"); !errors.Is(err, ErrNotFound) {
+		t.Error("Expected ErrNotFound, got", err)
+	}
+}
+
+// Counts Gets, to see which blocks a read touches
+type countingDatastore struct {
+	*userlib.MemDatastore
+	gets int
+}
+
+func (c *countingDatastore) Get(key string) ([]byte, bool) {
+	c.gets++
+	return c.MemDatastore.Get(key)
+}
+
+func TestReadAt(t *testing.T) {
+	b, mem := newBackend()
+	ds := &countingDatastore{MemDatastore: mem}
+	b.Datastore, b.ChunkSize = ds, 4
+	u := initUsers(t, b, "kim")[0]
+	u.StoreFile("alphabet", []byte("abcdefghij"))
+	u.AppendFile("alphabet", []byte("klmnopqrstuvwxyz"))
+
+	cases := []struct {
+		offset, length int
+		want           string
+	}{
+		{0, 3, "abc"},
+		{3, 6, "defghi"},
+		{9, 3, "jkl"},
+		{20, 100, "uvwxyz"},
+		{25, 1, "z"},
+		{5, 0, ""},
+		{24, math.MaxInt, "yz"},
+	}
+	for _, c := range cases {
+		v, err := u.ReadAt("alphabet", c.offset, c.length)
+		if err != nil || string(v) != c.want {
+			t.Error("ReadAt", c.offset, c.length, "gave", string(v), err)
+		}
+	}
+	if _, err := u.ReadAt("alphabet", 26, 1); err != io.EOF {
+		t.Error("Expected io.EOF past the end, got", err)
+	}
+	if _, err := u.ReadAt("alphabet", -1, 1); err == nil {
+		t.Error("Accepted a negative offset")
+	}
+
+	// The Inode, the SharingRecord and only the two blocks holding
+	// bytes 4..9
+	ds.gets = 0
+	u.ReadAt("alphabet", 4, 6)
+	if ds.gets != 4 {
+		t.Error("Expected 4 Gets, got", ds.gets)
+	}
+}
+
+func TestWriteAt(t *testing.T) {
+	b, ds := newBackend()
+	b.ChunkSize = 4
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+	alice.StoreFile("text", []byte("abcdefghijkl"))
+	msgid, _ := alice.ShareFile("text", "bob")
+	bob.ReceiveFile("text", "alice", msgid)
+
+	_, file, _ := alice.loadInode("text")
+	before, _ := alice.loadSharingRecord(file)
+
+	// Inside the middle block only, which makes way for what is left
+	// of it before, the new data and what is left after
+	if err := bob.WriteAt("text", 5, []byte("XY")); err != nil {
+		t.Fatal("WriteAt failed", err)
+	}
+	after, _ := alice.loadSharingRecord(file)
+	if len(after.Address) != 5 || after.Address[0] != before.Address[0] ||
+		after.Address[4] != before.Address[2] {
+		t.Error("WriteAt replaced the wrong blocks")
+	}
+	if _, status := ds.Get(before.Address[1]); status {
+		t.Error("Replaced block was not deleted")
+	}
+
+	steps := []struct {
+		offset int
+		data   string
+		want   string
+	}{
+		{3, "1234567", "abc1234567kl"},
+		{10, "KLMN", "abc1234567KLMN"},
+		{14, "op", "abc1234567KLMNop"},
+		{0, "", "abc1234567KLMNop"},
+	}
+	v, _ := alice.LoadFile("text")
+	if string(v) != "abcdeXYhijkl" {
+		t.Error("Wrong content", string(v))
+	}
+	for _, step := range steps {
+		if err := alice.WriteAt("text", step.offset, []byte(step.data)); err != nil {
+			t.Fatal("WriteAt failed", step.offset, err)
+		}
+		v, err := bob.LoadFile("text")
+		if err != nil || string(v) != step.want {
+			t.Error("WriteAt", step.offset, step.data, "gave", string(v), err)
+		}
+	}
+	if err := alice.WriteAt("text", 17, []byte("x")); err == nil {
+		t.Error("Wrote past the end")
+	}
+
+	// What the write leaves of others' blocks is still theirs, also
+	// when it lands inside a single block
+	alice.StoreFile("log", []byte("AAAA"))
+	msgid, _ = alice.ShareFile("log", "bob")
+	bob.ReceiveFile("log", "alice", msgid)
+	bob.AppendFile("log", []byte("BBBBBBBB"))
+	if err := alice.WriteAt("log", 5, []byte("x")); err != nil {
+		t.Fatal("WriteAt failed", err)
+	}
+	if err := alice.WriteAt("log", 9, []byte("y")); err != nil {
+		t.Fatal("WriteAt failed", err)
+	}
+	v, authors, err := bob.LoadFileWithAuthors("log")
+	if err != nil || string(v) != "AAAABxBBByBB" {
+		t.Fatal("Wrong content", string(v), err)
+	}
+	whom := func() string {
+		var who []byte
+		for _, a := range authors {
+			who = append(who, bytes.Repeat([]byte(a.Author[:1]), a.Length)...)
+		}
+		return string(who)
+	}
+	if who := whom(); who != "aaaababbbabb" {
+		t.Error("Wrong authors after WriteAt", who)
+	}
+
+	// Compact keeps the trimmed pieces as they are
+	bob.backend.ChunkSize = 4 << 10
+	if err = bob.Compact("log"); err != nil ||
+		blockCount(t, bob, "log") != 2 {
+		t.Fatal("Compact failed", err)
+	}
+	v, authors, err = alice.LoadFileWithAuthors("log")
+	if err != nil || string(v) != "AAAABxBBByBB" || whom() != "aaaababbbabb" {
+		t.Error("Compact changed the file", string(v), whom(), err)
+	}
+}
+
+// Blocks a later write deleted are a conflict, not tampering
+func TestReadDeletedBlocks(t *testing.T) {
+	b, ds := newBackend()
+	b.ChunkSize = 4
+	u := initUsers(t, b, "alice", "bob")
+	alice, bob := u[0], u[1]
+	alice.StoreFile("text", []byte("abcdefghijkl"))
+	msgid, _ := alice.ShareFile("text", "bob")
+	bob.ReceiveFile("text", "alice", msgid)
+
+	r, err := bob.OpenReader("text")
+	if err != nil {
+		t.Fatal("OpenReader failed", err)
+	}
+	buf := make([]byte, 4)
+	if _, err = r.Read(buf); err != nil || string(buf) != "abcd" {
+		t.Fatal("Read failed", string(buf), err)
+	}
+	alice.StoreFile("text", []byte("new"))
+	if _, err = r.Read(buf); !errors.Is(err, ErrConflict) ||
+		errors.Is(err, ErrIntegrity) {
+		t.Error("Expected ErrConflict, got", err)
+	}
+
+	// The server dropping a block the file still lists is tampering
+	_, file, _ := bob.loadInode("text")
+	shrecord, _ := bob.loadSharingRecord(file)
+	ds.Delete(shrecord.Address[0])
+	if _, err = bob.LoadFile("text"); !errors.Is(err, ErrIntegrity) {
+		t.Error("Expected ErrIntegrity, got", err)
+	}
+}
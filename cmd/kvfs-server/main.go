@@ -0,0 +1,49 @@
+// Command kvfs-server is the untrusted server: it serves a Datastore
+// and a Keystore over HTTP so that several clients can share files.
+// It only ever stores ciphertext and public keys.
+//
+//	kvfs-server -addr :8080 -dir /var/lib/kvfs -max-value 4194304
+//
+// Without -dir everything is kept in memory and lost on exit.  Values
+// larger than -max-value are refused, which bounds what a client can
+// store per key (the clients' default chunk size of 1 MiB fits well
+// below the default limit).  It also bounds a file's SharingRecord,
+// which lists every block: clients compact files written in small
+// appends (kvfs -compact-after) to stay below it.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/fenilfadadu/cs628-assn1/userlib"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	dir := flag.String("dir", "", "directory for persistent storage")
+	maxValue := flag.Int64("max-value", 4<<20,
+		"largest value accepted, in bytes (0 means no limit)")
+	flag.Parse()
+
+	var ds userlib.Datastore = userlib.NewMemDatastore()
+	var ks userlib.Keystore = userlib.NewMemKeystore()
+	if *dir != "" {
+		fileDs, err := userlib.OpenFileDatastore(filepath.Join(*dir, "data"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fileKs, err := userlib.OpenFileKeystore(filepath.Join(*dir, "keystore"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fileKs.Close()
+		ds, ks = fileDs, fileKs
+	}
+
+	log.Printf("kvfs-server listening on %s", *addr)
+	handler := userlib.NewStoreHandler(ds, ks, *maxValue)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
@@ -0,0 +1,512 @@
+// Command kvfs is the command-line client for the file share.
+//
+//	kvfs [-server URL] [-home DIR] [-chunk N] [-compact-after N] <command> [arguments]
+//
+// Commands:
+//
+//	init <username>                 create a user and log in
+//	login <username>                log in as an existing user
+//	logout                          forget the saved session
+//	ls [dir]                        list our files (or a directory):
+//	                                size, owner (with "shared" for files
+//	                                shared with us) and name
+//	mkdir <dir>                     create a directory
+//	rmdir <dir>                     remove an empty directory (a shared-in
+//	                                one is only dropped from our namespace)
+//	put <name> <localfile>          store a file (- reads stdin)
+//	get <name> [localfile]          load a file (default: stdout)
+//	append <name> <localfile>       append to a file (- reads stdin)
+//	authors <name>                  show who wrote each part of a file
+//	compact <name>                  merge the small blocks of a file
+//	rm <name>                       delete a file (a shared-in file is
+//	                                only dropped from our namespace)
+//	mv <name> <newname>             rename a file or directory in our
+//	                                namespace
+//	share <name> <user> [ro|rw]     share a file or a directory (default
+//	                                read-write), prints the msgid
+//	receive <name> <sender> <msgid> accept a shared file or directory
+//	                                as <name>
+//	collaborators <name>            list who shared the file with whom
+//	revoke <name> [user]            revoke user's access (and everybody
+//	                                they shared with), or everybody else's
+//
+// Names are paths: "/" separates the directories on the way to a file.
+//
+// Without -server the Datastore and Keystore live in files under the
+// home directory ($KVFS_HOME, or ~/.kvfs).  The password is read from
+// $KVFS_PASSWORD or prompted for on the terminal.
+//
+// init and login save the session in the home directory so that the
+// other commands skip the expensive password check of GetUser.  Every
+// command updates it with the file versions it saw, so that a server
+// rolling a file back is caught across invocations.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aniketp/key-value-file-share/assn1"
+	"github.com/fenilfadadu/cs628-assn1/userlib"
+)
+
+// Saved session: where the stores are and who is logged in, and the
+// server's key history as far as it was verified
+type session struct {
+	Server string
+	User   json.RawMessage
+	Keys   []userlib.KeyRecord `json:",omitempty"`
+}
+
+type command struct {
+	args  string
+	nargs []int
+	run   func(c *client, args []string) error
+}
+
+var commands = map[string]command{
+	"init":    {"<username>", []int{1}, cmdInit},
+	"login":   {"<username>", []int{1}, cmdLogin},
+	"logout":  {"", []int{0}, cmdLogout},
+	"ls":      {"[dir]", []int{0, 1}, cmdLs},
+	"mkdir":   {"<dir>", []int{1}, cmdMkdir},
+	"rmdir":   {"<dir>", []int{1}, cmdRmdir},
+	"put":     {"<name> <localfile>", []int{2}, cmdPut},
+	"get":     {"<name> [localfile]", []int{1, 2}, cmdGet},
+	"append":  {"<name> <localfile>", []int{2}, cmdAppend},
+	"authors": {"<name>", []int{1}, cmdAuthors},
+	"compact": {"<name>", []int{1}, cmdCompact},
+	"rm":      {"<name>", []int{1}, cmdRm},
+	"mv":      {"<name> <newname>", []int{2}, cmdMv},
+	"share":   {"<name> <user> [ro|rw]", []int{2, 3}, cmdShare},
+	"receive": {"<name> <sender> <msgid>", []int{3}, cmdReceive},
+	"revoke":  {"<name> [user]", []int{1, 2}, cmdRevoke},
+
+	"collaborators": {"<name>", []int{1}, cmdCollaborators},
+}
+
+// Everything a command needs: the home directory, the selected server
+// and, once logged in, the user
+type client struct {
+	home    string
+	server  string
+	chunk   int
+	compact int
+	backend assn1.Backend
+	closers []io.Closer
+	user    *assn1.User
+}
+
+func main() {
+	home := flag.String("home", defaultHome(), "client state directory")
+	server := flag.String("server", os.Getenv("KVFS_SERVER"),
+		"URL of a kvfs-server (default: local files)")
+	chunk := flag.Int("chunk", assn1.DefaultChunkSize,
+		"size of the blocks files are written in")
+	compact := flag.Int("compact-after", assn1.DefaultCompactAfter,
+		"compact a file every this many blocks appended (negative: never)")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]]
+	if !ok || !validArgs(cmd, len(args)-1) {
+		usage()
+		os.Exit(2)
+	}
+
+	c := &client{home: *home, server: *server, chunk: *chunk,
+		compact: *compact}
+	err := cmd.run(c, args[1:])
+	if err == nil && c.user != nil {
+		// Keep what the session learned, e.g. the file versions it saw
+		err = c.save()
+	}
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kvfs %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: kvfs [flags] <command> [arguments]\n\n")
+	for _, name := range []string{"init", "login", "logout", "ls",
+		"mkdir", "rmdir", "put", "get", "append", "authors", "compact",
+		"rm", "mv", "share", "receive", "collaborators", "revoke"} {
+		fmt.Fprintf(os.Stderr, "  %-13s %s\n", name, commands[name].args)
+	}
+	fmt.Fprintf(os.Stderr, "\nflags:\n")
+	flag.PrintDefaults()
+}
+
+func validArgs(cmd command, n int) bool {
+	for _, want := range cmd.nargs {
+		if n == want {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultHome() string {
+	if home := os.Getenv("KVFS_HOME"); home != "" {
+		return home
+	}
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		return ".kvfs"
+	}
+	return filepath.Join(dir, ".kvfs")
+}
+
+func (c *client) sessionPath() string {
+	return filepath.Join(c.home, "session")
+}
+
+// Binds the client to the HTTP server, or to the local file stores
+func (c *client) open() error {
+	if c.server != "" {
+		c.backend = assn1.Backend{
+			Datastore:    userlib.NewHTTPDatastore(c.server, nil),
+			Keystore:     userlib.NewHTTPKeystore(c.server, nil),
+			ChunkSize:    c.chunk,
+			CompactAfter: c.compact,
+		}
+		return nil
+	}
+
+	ds, err := userlib.OpenFileDatastore(filepath.Join(c.home, "data"))
+	if err != nil {
+		return err
+	}
+	ks, err := userlib.OpenFileKeystore(filepath.Join(c.home, "keystore"))
+	if err != nil {
+		return err
+	}
+	c.closers = append(c.closers, ks)
+	c.backend = assn1.Backend{Datastore: ds, Keystore: ks,
+		ChunkSize: c.chunk, CompactAfter: c.compact}
+	return nil
+}
+
+// Restores the saved session, including the server it was created on
+func (c *client) resume() error {
+	raw, err := os.ReadFile(c.sessionPath())
+	if os.IsNotExist(err) {
+		return errors.New("not logged in, run kvfs login first")
+	} else if err != nil {
+		return err
+	}
+	var s session
+	if err = json.Unmarshal(raw, &s); err != nil {
+		return fmt.Errorf("corrupt session file: %v", err)
+	}
+
+	c.server = s.Server
+	if err = c.open(); err != nil {
+		return err
+	}
+	if ks, ok := c.backend.Keystore.(*userlib.HTTPKeystore); ok {
+		// Otherwise the server could serve any history it likes
+		if err = ks.Trust(s.Keys); err != nil {
+			return fmt.Errorf("corrupt session file: %v", err)
+		}
+	}
+	c.user, err = c.backend.ResumeSession(s.User)
+	return err
+}
+
+// Saves the session readable by the owner only
+func (c *client) save() error {
+	raw, err := c.user.Session()
+	if err != nil {
+		return err
+	}
+	s := session{Server: c.server, User: raw}
+	if ks, ok := c.backend.Keystore.(*userlib.HTTPKeystore); ok {
+		s.Keys = ks.Trusted()
+	}
+	out, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(c.home, 0700); err != nil {
+		return err
+	}
+	tmp := c.sessionPath() + ".tmp"
+	if err = os.WriteFile(tmp, out, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.sessionPath())
+}
+
+func readPassword() (string, error) {
+	if password := os.Getenv("KVFS_PASSWORD"); password != "" {
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Reads a local file, "-" meaning stdin
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+func cmdInit(c *client, args []string) error {
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(c.home, 0700); err != nil {
+		return err
+	}
+	if err = c.open(); err != nil {
+		return err
+	}
+	c.user, err = c.backend.InitUser(args[0], password)
+	return err
+}
+
+func cmdLogin(c *client, args []string) error {
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	if err = c.open(); err != nil {
+		return err
+	}
+	c.user, err = c.backend.GetUser(args[0], password)
+	return err
+}
+
+func cmdLogout(c *client, args []string) error {
+	err := os.Remove(c.sessionPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func cmdLs(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	var files []assn1.FileInfo
+	var err error
+	if len(args) == 0 {
+		files, err = c.user.ListFiles()
+	} else {
+		files, err = c.user.ListDir(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		owner, name := file.Owner, file.Name
+		if !file.Owned {
+			owner += " (shared)"
+		}
+		if file.Dir {
+			name += "/"
+		}
+		if file.Err != nil {
+			fmt.Printf("?\t%s\t%s: %v\n", owner, name, file.Err)
+			continue
+		}
+		fmt.Printf("%d\t%s\t%s\n", file.Size, owner, name)
+	}
+	return nil
+}
+
+func cmdMkdir(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	return c.user.MkDir(args[0])
+}
+
+func cmdRmdir(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	return c.user.RemoveDir(args[0])
+}
+
+func cmdPut(c *client, args []string) error {
+	data, err := readInput(args[1])
+	if err != nil {
+		return err
+	}
+	if err = c.resume(); err != nil {
+		return err
+	}
+	return c.user.StoreFile(args[0], data)
+}
+
+// Files are streamed so that they never have to fit in memory
+func cmdGet(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	r, err := c.user.OpenReader(args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if len(args) == 1 || args[1] == "-" {
+		_, err = io.Copy(os.Stdout, r)
+		return err
+	}
+
+	// Only a fully verified file replaces the local one
+	tmp := args[1] + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, args[1])
+}
+
+func cmdAppend(c *client, args []string) error {
+	in := os.Stdin
+	if args[1] != "-" {
+		f, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if err := c.resume(); err != nil {
+		return err
+	}
+	w, err := c.user.OpenAppender(args[0])
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, in); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func cmdAuthors(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	_, authors, err := c.user.LoadFileWithAuthors(args[0])
+	if err != nil {
+		return err
+	}
+	for _, block := range authors {
+		fmt.Printf("%d\t%d\t%s\n", block.Offset, block.Length, block.Author)
+	}
+	return nil
+}
+
+func cmdCompact(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	return c.user.Compact(args[0])
+}
+
+func cmdRm(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	return c.user.DeleteFile(args[0])
+}
+
+func cmdMv(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	return c.user.RenameFile(args[0], args[1])
+}
+
+func cmdShare(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	mode := assn1.ReadWrite
+	if len(args) == 3 {
+		switch args[2] {
+		case "ro":
+			mode = assn1.ReadOnly
+		case "rw":
+		default:
+			return fmt.Errorf("unknown mode %q, want ro or rw", args[2])
+		}
+	}
+	msgid, err := c.user.ShareFileWithMode(args[0], args[1], mode)
+	if err != nil {
+		return err
+	}
+	fmt.Println(msgid)
+	return nil
+}
+
+func cmdReceive(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	return c.user.ReceiveFile(args[0], args[1], args[2])
+}
+
+func cmdCollaborators(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	tree, err := c.user.ListCollaborators(args[0])
+	if err != nil {
+		return err
+	}
+	for _, grant := range tree {
+		fmt.Printf("%s\t%s -> %s (%s)\n",
+			grant.Time.Local().Format(time.RFC3339),
+			grant.Grantor, grant.Grantee, grant.Mode)
+	}
+	return nil
+}
+
+func cmdRevoke(c *client, args []string) error {
+	if err := c.resume(); err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		return c.user.RevokeUser(args[0], args[1])
+	}
+	return c.user.RevokeFile(args[0])
+}
@@ -0,0 +1,102 @@
+package userlib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Prefix of the scratch files used for atomic writes
+const tempPrefix = ".tmp-"
+
+// FileDatastore is a durable Datastore keeping one file per key inside
+// a single directory.  Every Set writes a scratch file, fsyncs it and
+// renames it over the old value, so a crash leaves either the old or
+// the new value but never a torn one.
+type FileDatastore struct {
+	dir string
+}
+
+// OpenFileDatastore opens (creating if needed) the datastore kept in
+// dir, dropping scratch files left behind by an interrupted Set.
+func OpenFileDatastore(dir string) (*FileDatastore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempPrefix) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	return &FileDatastore{dir: dir}, nil
+}
+
+// Keys are hashed so any string maps to a short, safe file name
+func (f *FileDatastore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(f.dir, hex.EncodeToString(sum[:]))
+}
+
+// Get reports a value that can't be read as missing, see GetChecked
+func (f *FileDatastore) Get(key string) (value []byte, ok bool) {
+	value, ok, _ = f.GetChecked(key)
+	return value, ok
+}
+
+func (f *FileDatastore) GetChecked(key string) (value []byte, ok bool,
+	err error) {
+	value, err = os.ReadFile(f.path(key))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (f *FileDatastore) Set(key string, value []byte) error {
+	tmp, err := os.CreateTemp(f.dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(value); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), f.path(key))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return f.syncDir()
+}
+
+func (f *FileDatastore) Delete(key string) error {
+	err := os.Remove(f.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return f.syncDir()
+}
+
+// Makes renames and removals inside the directory durable
+func (f *FileDatastore) syncDir() error {
+	dir, err := os.Open(f.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,52 @@
+package userlib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileDatastore(t *testing.T) {
+	dir := t.TempDir()
+	var ds Datastore
+	ds, err := OpenFileDatastore(dir)
+	if err != nil {
+		t.Fatal("Open failed", err)
+	}
+
+	if err = ds.Set("foo", []byte("bar")); err != nil {
+		t.Error("Set failed", err)
+	}
+	if err = ds.Set("foo", []byte("baz")); err != nil {
+		t.Error("Overwrite failed", err)
+	}
+	if _, valid := ds.Get("bar"); valid {
+		t.Error("Improper fetch")
+	}
+
+	// Leave a scratch file behind, as an interrupted Set would
+	os.WriteFile(filepath.Join(dir, tempPrefix+"x"), []byte("junk"), 0600)
+
+	ds, err = OpenFileDatastore(dir)
+	if err != nil {
+		t.Fatal("Reopen failed", err)
+	}
+	data, valid := ds.Get("foo")
+	if !valid || string(data) != "baz" {
+		t.Error("Value didn't survive a reopen", string(data))
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Error("Scratch file not cleaned up", len(entries))
+	}
+
+	if err = ds.Delete("foo"); err != nil {
+		t.Error("Delete failed", err)
+	}
+	if err = ds.Delete("foo"); err != nil {
+		t.Error("Delete of a missing key failed", err)
+	}
+	if _, valid = ds.Get("foo"); valid {
+		t.Error("Delete did not remove the key")
+	}
+}
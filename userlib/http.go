@@ -0,0 +1,344 @@
+package userlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// The HTTP layout shared by NewStoreHandler and the HTTP clients:
+//
+//	GET/PUT/DELETE /data/<key>   opaque datastore values
+//	GET/PUT        /keys/<name>  JSON encoded public keys
+//	GET            /keys         the JSON encoded KeyRecord history
+const (
+	dataPrefix = "/data/"
+	keysPath   = "/keys"
+)
+
+// Returned by the HTTP clients when the server's key history does not
+// extend the history they saw before.
+var ErrHistoryRewritten = errors.New("userlib: keystore history was rewritten")
+
+// NewStoreHandler serves ds and ks over HTTP.  The server is the
+// untrusted party: it only ever sees what clients hand it, which for
+// assn1 is ciphertext and public keys.  Datastore values larger than
+// maxValueSize bytes are refused with 413 Request Entity Too Large; 0
+// means no limit.
+func NewStoreHandler(ds Datastore, ks Keystore, maxValueSize int64) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dataPrefix, func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, dataPrefix)
+		if key == "" {
+			http.Error(w, "missing key", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			// A failed lookup must not pass for a missing key
+			value, ok, err := GetChecked(ds, key)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			} else if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(value)
+		case http.MethodPut:
+			body := r.Body
+			if maxValueSize > 0 {
+				body = http.MaxBytesReader(w, body, maxValueSize)
+			}
+			value, err := io.ReadAll(body)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err = ds.Set(key, value); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			if err := ds.Delete(key); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc(keysPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, ks.History())
+	})
+	mux.HandleFunc(keysPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, keysPath+"/")
+		if name == "" {
+			http.Error(w, "missing name", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			value, ok := ks.Get(name)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, value)
+		case http.MethodPut:
+			var value PublicKey
+			if err := json.NewDecoder(r.Body).Decode(&value); err != nil ||
+				value.N == nil {
+				http.Error(w, "bad public key", http.StatusBadRequest)
+				return
+			}
+			err := ks.Register(name, value)
+			if err == ErrKeyExists {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// Sends a request and turns unexpected status codes into errors
+func do(client *http.Client, method string, url string, body []byte,
+	want ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range want {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	resp.Body.Close()
+	return resp, fmt.Errorf("userlib: %s %s: %s: %s", method, url,
+		resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// HTTPDatastore is a Datastore served by NewStoreHandler.  Get can not
+// tell a missing key from an unreachable server and reports both as
+// not found; GetChecked only reports a 404 as not found.
+type HTTPDatastore struct {
+	base   string
+	client *http.Client
+}
+
+// NewHTTPDatastore talks to the server at baseURL (e.g.
+// "http://localhost:8080").  A nil client means http.DefaultClient.
+func NewHTTPDatastore(baseURL string, client *http.Client) *HTTPDatastore {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPDatastore{base: strings.TrimRight(baseURL, "/"), client: client}
+}
+
+func (h *HTTPDatastore) url(key string) string {
+	return h.base + dataPrefix + url.PathEscape(key)
+}
+
+func (h *HTTPDatastore) Get(key string) (value []byte, ok bool) {
+	value, ok, _ = h.GetChecked(key)
+	return value, ok
+}
+
+func (h *HTTPDatastore) GetChecked(key string) (value []byte, ok bool,
+	err error) {
+	resp, err := do(h.client, http.MethodGet, h.url(key), nil,
+		http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	value, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+func (h *HTTPDatastore) Set(key string, value []byte) error {
+	resp, err := do(h.client, http.MethodPut, h.url(key), value,
+		http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (h *HTTPDatastore) Delete(key string) error {
+	resp, err := do(h.client, http.MethodDelete, h.url(key), nil,
+		http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// HTTPKeystore is a Keystore served by NewStoreHandler.  Since the
+// server is untrusted, keys are never taken from it one by one: the
+// client downloads the whole history, verifies the chain and checks
+// that it extends the history it already trusted before answering.
+// A client that doesn't live long should keep that history between
+// runs, see Trusted and Trust.
+type HTTPKeystore struct {
+	base   string
+	client *http.Client
+
+	mu  sync.Mutex
+	log keyLog
+}
+
+// NewHTTPKeystore talks to the server at baseURL.  A nil client means
+// http.DefaultClient.
+func NewHTTPKeystore(baseURL string, client *http.Client) *HTTPKeystore {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &HTTPKeystore{
+		base:   strings.TrimRight(baseURL, "/"),
+		client: client,
+		log:    newKeyLog(),
+	}
+}
+
+// Fetches the server's history and appends the new records to ours.
+// Must be called with h.mu held.
+func (h *HTTPKeystore) refresh() error {
+	resp, err := do(h.client, http.MethodGet, h.base+keysPath, nil,
+		http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var records []KeyRecord
+	if err = json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return err
+	}
+	if err = VerifyHistory(records); err != nil {
+		return err
+	}
+	known := len(h.log.records)
+	if len(records) < known ||
+		(known > 0 && !Equal(records[known-1].Hash, h.log.records[known-1].Hash)) {
+		return ErrHistoryRewritten
+	}
+	for _, r := range records[known:] {
+		h.log.apply(r)
+	}
+	return nil
+}
+
+func (h *HTTPKeystore) Get(name string) (value PublicKey, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if value, ok = h.log.keys[name]; ok {
+		return
+	}
+	if h.refresh() != nil {
+		return PublicKey{}, false
+	}
+	value, ok = h.log.keys[name]
+	return
+}
+
+func (h *HTTPKeystore) Register(name string, value PublicKey) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	resp, err := do(h.client, http.MethodPut,
+		h.base+keysPath+"/"+url.PathEscape(name), body, http.StatusCreated)
+	if resp != nil && resp.StatusCode == http.StatusConflict {
+		return ErrKeyExists
+	} else if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// Make sure the server actually recorded our key
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err = h.refresh(); err != nil {
+		return err
+	}
+	got, ok := h.log.keys[name]
+	if !ok || got.E != value.E || got.N.Cmp(value.N) != 0 {
+		return fmt.Errorf("userlib: server did not register %q", name)
+	}
+	return nil
+}
+
+// Trust seeds the client with a history it verified before, e.g. one
+// saved from Trusted by an earlier process.  The server's history must
+// extend it from then on.  It is meant for a client not used yet.
+func (h *HTTPKeystore) Trust(records []KeyRecord) error {
+	if err := VerifyHistory(records); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.log.records) > 0 {
+		return errors.New("userlib: keystore history already trusted")
+	}
+	for _, r := range records {
+		h.log.apply(r)
+	}
+	return nil
+}
+
+// Trusted returns the history verified so far, without asking the
+// server, to be handed to Trust later.
+func (h *HTTPKeystore) Trusted() []KeyRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.log.history()
+}
+
+// History returns the verified history as of the last refresh.
+func (h *HTTPKeystore) History() []KeyRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.refresh()
+	return h.log.history()
+}
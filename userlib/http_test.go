@@ -0,0 +1,105 @@
+package userlib
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Every lookup fails, like a disk giving I/O errors
+type brokenDatastore struct {
+	*MemDatastore
+}
+
+func (brokenDatastore) GetChecked(key string) ([]byte, bool, error) {
+	return nil, false, errors.New("input/output error")
+}
+
+func TestHTTPStores(t *testing.T) {
+	mem := NewMemKeystore()
+	server := httptest.NewServer(NewStoreHandler(NewMemDatastore(), mem, 64))
+	defer server.Close()
+
+	var ds Datastore = NewHTTPDatastore(server.URL, nil)
+	if err := ds.Set("foo", []byte("bar")); err != nil {
+		t.Fatal("Set failed", err)
+	}
+	data, valid := ds.Get("foo")
+	if !valid || string(data) != "bar" {
+		t.Error("Improper fetch", string(data))
+	}
+	if err := ds.Delete("foo"); err != nil {
+		t.Error("Delete failed", err)
+	}
+	if _, valid = ds.Get("foo"); valid {
+		t.Error("Delete did not remove the key")
+	}
+	if err := ds.Set("big", make([]byte, 65)); err == nil {
+		t.Error("Server took a value over its limit")
+	}
+	if _, valid = ds.Get("big"); valid {
+		t.Error("Oversized value was stored")
+	}
+
+	// Only the server saying so makes a key missing
+	checked := ds.(CheckedDatastore)
+	if _, ok, err := checked.GetChecked("foo"); ok || err != nil {
+		t.Error("Missing key reported wrong", ok, err)
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	if _, ok, err := GetChecked(NewHTTPDatastore(down.URL, nil), "foo"); ok ||
+		err == nil {
+		t.Error("Unreachable server reported as a missing key")
+	}
+	failing := httptest.NewServer(NewStoreHandler(brokenDatastore{}, mem, 0))
+	defer failing.Close()
+	if _, ok, err := GetChecked(NewHTTPDatastore(failing.URL, nil), "foo"); ok ||
+		err == nil {
+		t.Error("Failed lookup on the server reported as a missing key")
+	}
+
+	key, err := GenerateRSAKey()
+	if err != nil {
+		t.Fatal("Got RSA error", err)
+	}
+	ks := NewHTTPKeystore(server.URL, nil)
+	if err = ks.Register("foo", key.PublicKey); err != nil {
+		t.Error("Register failed", err)
+	}
+	if err = ks.Register("foo", key.PublicKey); err != ErrKeyExists {
+		t.Error("Second register of foo should fail", err)
+	}
+
+	// A second client learns the key from the server's history
+	other := NewHTTPKeystore(server.URL, nil)
+	val, ok := other.Get("foo")
+	if !ok || val.N.Cmp(key.PublicKey.N) != 0 {
+		t.Error("Didn't fetch right")
+	}
+	if _, ok = other.Get("bar"); ok {
+		t.Error("Got a key when I shouldn't")
+	}
+
+	// The server swaps in a fresh history; clients must notice, also
+	// new ones that were handed the history trusted before
+	saved := ks.Trusted()
+	mem.mu.Lock()
+	mem.log = newKeyLog()
+	mem.mu.Unlock()
+	mem.Register("bar", key.PublicKey)
+	if err = ks.Register("baz", key.PublicKey); err != ErrHistoryRewritten {
+		t.Error("Rewritten history went unnoticed", err)
+	}
+	seeded := NewHTTPKeystore(server.URL, nil)
+	if err = seeded.Trust(saved); err != nil {
+		t.Fatal("Trust failed", err)
+	}
+	if _, ok = seeded.Get("bar"); ok {
+		t.Error("Seeded client took a key from a rewritten history")
+	}
+	if err = seeded.Trust(saved); err == nil {
+		t.Error("Trusted a second history")
+	}
+}
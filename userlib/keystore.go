@@ -0,0 +1,296 @@
+package userlib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// RSA public key's type
+type PublicKey = rsa.PublicKey
+
+// Returned by Keystore.Register when the name already has a key.
+var ErrKeyExists = errors.New("userlib: name already has a registered key")
+
+// Keystore is the public key directory.  Registration is
+// first-writer-wins: once a name has a key it can never be replaced,
+// and every registration is recorded in an append-only history.
+type Keystore interface {
+	Get(name string) (value PublicKey, ok bool)
+	Register(name string, value PublicKey) error
+	History() []KeyRecord
+}
+
+// KeyRecord is one entry of a Keystore's registration history.  Each
+// record commits to the previous one through PrevHash, so the history
+// can not be rewritten without breaking the chain.
+type KeyRecord struct {
+	Seq      int
+	Name     string
+	Key      PublicKey
+	Time     time.Time
+	PrevHash []byte
+	Hash     []byte
+}
+
+// Computes the chained hash of a record (everything but Hash itself)
+func (r *KeyRecord) digest() []byte {
+	h := sha256.New()
+	var num [8]byte
+	binary.BigEndian.PutUint64(num[:], uint64(r.Seq))
+	h.Write(num[:])
+	binary.BigEndian.PutUint64(num[:], uint64(len(r.Name)))
+	h.Write(num[:])
+	h.Write([]byte(r.Name))
+	if r.Key.N != nil {
+		h.Write(r.Key.N.Bytes())
+	}
+	binary.BigEndian.PutUint64(num[:], uint64(r.Key.E))
+	h.Write(num[:])
+	binary.BigEndian.PutUint64(num[:], uint64(r.Time.UnixNano()))
+	h.Write(num[:])
+	h.Write(r.PrevHash)
+	return h.Sum(nil)
+}
+
+// VerifyHistory checks that records form an unbroken hash chain
+// starting at sequence number zero, with no name registered twice.
+func VerifyHistory(records []KeyRecord) error {
+	var prev []byte
+	seen := make(map[string]bool)
+	for i := range records {
+		r := &records[i]
+		if r.Seq != i {
+			return fmt.Errorf("userlib: key record %d out of sequence", i)
+		}
+		if !bytes.Equal(r.PrevHash, prev) || !Equal(r.Hash, r.digest()) {
+			return fmt.Errorf("userlib: key record %d breaks the chain", i)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("userlib: %q registered twice", r.Name)
+		}
+		seen[r.Name] = true
+		prev = r.Hash
+	}
+	return nil
+}
+
+// keyLog is the state shared by the Keystore implementations: the
+// current name to key map and the history that produced it.
+type keyLog struct {
+	keys    map[string]PublicKey
+	records []KeyRecord
+}
+
+func newKeyLog() keyLog {
+	return keyLog{keys: make(map[string]PublicKey)}
+}
+
+// Builds (but does not apply) the next record for name
+func (l *keyLog) next(name string, value PublicKey) (KeyRecord, error) {
+	if _, ok := l.keys[name]; ok {
+		return KeyRecord{}, ErrKeyExists
+	}
+	r := KeyRecord{
+		Seq:  len(l.records),
+		Name: name,
+		Key:  value,
+		Time: time.Now().UTC(),
+	}
+	if r.Seq > 0 {
+		r.PrevHash = l.records[r.Seq-1].Hash
+	}
+	r.Hash = r.digest()
+	return r, nil
+}
+
+func (l *keyLog) apply(r KeyRecord) {
+	l.keys[r.Name] = r.Key
+	l.records = append(l.records, r)
+}
+
+func (l *keyLog) history() []KeyRecord {
+	return append([]KeyRecord(nil), l.records...)
+}
+
+// MemKeystore is an isolated in-memory Keystore, safe for concurrent
+// use.
+type MemKeystore struct {
+	mu  sync.RWMutex
+	log keyLog
+}
+
+func NewMemKeystore() *MemKeystore {
+	return &MemKeystore{log: newKeyLog()}
+}
+
+func (m *MemKeystore) Get(name string) (value PublicKey, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok = m.log.keys[name]
+	return
+}
+
+func (m *MemKeystore) Register(name string, value PublicKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, err := m.log.next(name, value)
+	if err != nil {
+		return err
+	}
+	m.log.apply(r)
+	return nil
+}
+
+func (m *MemKeystore) History() []KeyRecord {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.log.history()
+}
+
+// FileKeystore is a Keystore persisted as an append-only file with
+// one JSON encoded KeyRecord per line.  The chain is verified when
+// the file is opened.
+type FileKeystore struct {
+	mu   sync.RWMutex
+	log  keyLog
+	file *os.File
+}
+
+// OpenFileKeystore opens (creating if needed) the keystore at path.
+func OpenFileKeystore(path string) (*FileKeystore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &FileKeystore{log: newKeyLog(), file: file}
+	var records []KeyRecord
+	var good int64
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// A torn final line is a registration that never
+			// committed, drop it
+			break
+		}
+		var r KeyRecord
+		if err = json.Unmarshal(line, &r); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("userlib: corrupt keystore %s: %v",
+				path, err)
+		}
+		records = append(records, r)
+		good += int64(len(line))
+	}
+	if err = VerifyHistory(records); err != nil {
+		file.Close()
+		return nil, err
+	}
+	for _, r := range records {
+		ks.log.apply(r)
+	}
+
+	if err = file.Truncate(good); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(good, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (f *FileKeystore) Get(name string) (value PublicKey, ok bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	value, ok = f.log.keys[name]
+	return
+}
+
+func (f *FileKeystore) Register(name string, value PublicKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, err := f.log.next(name, value)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = f.file.Write(append(line, '\n')); err == nil {
+		err = f.file.Sync()
+	}
+	if err != nil {
+		// Cut off what made it to the file, so that neither a torn
+		// line nor a record we didn't apply is left before the next
+		f.file.Truncate(offset)
+		f.file.Seek(offset, io.SeekStart)
+		return err
+	}
+	f.log.apply(r)
+	return nil
+}
+
+func (f *FileKeystore) History() []KeyRecord {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.log.history()
+}
+
+func (f *FileKeystore) Close() error {
+	return f.file.Close()
+}
+
+// globalKeystore applies the Keystore rules on top of the
+// package-level keystore map.  KeystoreSet still bypasses them, which
+// is only meant for tests.
+type globalKeystore struct{}
+
+var keystoreMu sync.Mutex
+var keystoreLog = newKeyLog()
+
+func (globalKeystore) Get(name string) (value PublicKey, ok bool) {
+	return KeystoreGet(name)
+}
+
+func (globalKeystore) Register(name string, value PublicKey) error {
+	keystoreMu.Lock()
+	defer keystoreMu.Unlock()
+	if _, ok := KeystoreGet(name); ok {
+		return ErrKeyExists
+	}
+	r, err := keystoreLog.next(name, value)
+	if err != nil {
+		return err
+	}
+	keystoreLog.apply(r)
+	KeystoreSet(name, value)
+	return nil
+}
+
+func (globalKeystore) History() []KeyRecord {
+	keystoreMu.Lock()
+	defer keystoreMu.Unlock()
+	return keystoreLog.history()
+}
+
+// The package-level keystore, as a Keystore
+var DefaultKeystore Keystore = globalKeystore{}
@@ -0,0 +1,83 @@
+package userlib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemKeystore(t *testing.T) {
+	key, err := GenerateRSAKey()
+	if err != nil {
+		t.Fatal("Got RSA error", err)
+	}
+	other, err := GenerateRSAKey()
+	if err != nil {
+		t.Fatal("Got RSA error", err)
+	}
+
+	var ks Keystore = NewMemKeystore()
+	if err = ks.Register("foo", key.PublicKey); err != nil {
+		t.Error("Register failed", err)
+	}
+	if err = ks.Register("foo", other.PublicKey); err != ErrKeyExists {
+		t.Error("Second register of foo should fail", err)
+	}
+	val, ok := ks.Get("foo")
+	if !ok || val.N.Cmp(key.PublicKey.N) != 0 {
+		t.Error("First writer didn't win")
+	}
+	if err = ks.Register("bar", other.PublicKey); err != nil {
+		t.Error("Register failed", err)
+	}
+
+	history := ks.History()
+	if len(history) != 2 || VerifyHistory(history) != nil {
+		t.Error("Bad history", history)
+	}
+	history[0].Name = "baz"
+	if VerifyHistory(history) == nil {
+		t.Error("Tampered history verified")
+	}
+}
+
+func TestFileKeystore(t *testing.T) {
+	key, err := GenerateRSAKey()
+	if err != nil {
+		t.Fatal("Got RSA error", err)
+	}
+	path := filepath.Join(t.TempDir(), "keystore")
+
+	ks, err := OpenFileKeystore(path)
+	if err != nil {
+		t.Fatal("Open failed", err)
+	}
+	if err = ks.Register("foo", key.PublicKey); err != nil {
+		t.Error("Register failed", err)
+	}
+	ks.Close()
+
+	// Simulate a crash halfway through the next registration
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte(`{"Seq":1,"Name":"ba`))
+	file.Close()
+
+	ks, err = OpenFileKeystore(path)
+	if err != nil {
+		t.Fatal("Reopen failed", err)
+	}
+	defer ks.Close()
+	val, ok := ks.Get("foo")
+	if !ok || val.N.Cmp(key.PublicKey.N) != 0 {
+		t.Error("Key didn't survive a reopen")
+	}
+	if err = ks.Register("foo", key.PublicKey); err != ErrKeyExists {
+		t.Error("Reopened keystore forgot foo", err)
+	}
+	if err = ks.Register("bar", key.PublicKey); err != nil {
+		t.Error("Register after torn write failed", err)
+	}
+	if h := ks.History(); len(h) != 2 || VerifyHistory(h) != nil {
+		t.Error("Bad history", h)
+	}
+}
@@ -1,14 +1,17 @@
 package userlib
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"io"
 
 	"crypto"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
@@ -34,6 +37,9 @@ var HashSize = sha256.Size
 // AES keysize
 var AESKeySize = 16
 
+// AES-GCM nonce size
+var NonceSize = 12
+
 // RSA keysize
 var RSAKeySize = 2048
 
@@ -92,10 +98,114 @@ func DatastoreClear() {
 	datastore = make(map[string][]byte)
 }
 
+// Datastore is the untrusted key-value store a session reads and
+// writes.  Get returns a private copy of the value, Set stores a copy
+// of the value and Delete is a no-op for missing keys.
+type Datastore interface {
+	Get(key string) (value []byte, ok bool)
+	Set(key string, value []byte) error
+	Delete(key string) error
+}
+
+// CheckedDatastore is a Datastore whose lookups can fail, like one
+// reached over the network.  GetChecked tells a missing key (ok false,
+// err nil) from a lookup that failed (err set), which Get can't.
+type CheckedDatastore interface {
+	Datastore
+	GetChecked(key string) (value []byte, ok bool, err error)
+}
+
+// GetChecked looks key up in ds, reporting failed lookups when ds is a
+// CheckedDatastore.  Lookups in any other Datastore never fail.
+func GetChecked(ds Datastore, key string) (value []byte, ok bool, err error) {
+	if checked, is := ds.(CheckedDatastore); is {
+		return checked.GetChecked(key)
+	}
+	value, ok = ds.Get(key)
+	return value, ok, nil
+}
+
+// globalDatastore routes the Datastore methods to the package-level
+// map above, so DatastoreClear and DatastoreGetMap keep working.
+type globalDatastore struct{}
+
+func (globalDatastore) Get(key string) ([]byte, bool) {
+	return DatastoreGet(key)
+}
+
+func (globalDatastore) Set(key string, value []byte) error {
+	DatastoreSet(key, value)
+	return nil
+}
+
+func (globalDatastore) Delete(key string) error {
+	DatastoreDelete(key)
+	return nil
+}
+
+// The package-level datastore, as a Datastore
+var DefaultDatastore Datastore = globalDatastore{}
+
+// MemDatastore is an isolated in-memory Datastore, safe for
+// concurrent use.  The zero value is not usable, see NewMemDatastore.
+type MemDatastore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func NewMemDatastore() *MemDatastore {
+	return &MemDatastore{data: make(map[string][]byte)}
+}
+
+func (m *MemDatastore) Get(key string) (value []byte, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok = m.data[key]
+	if ok && value != nil {
+		foo := make([]byte, len(value))
+		copy(foo, value)
+		return foo, ok
+	}
+	return
+}
+
+func (m *MemDatastore) Set(key string, value []byte) error {
+	foo := make([]byte, len(value))
+	copy(foo, value)
+	m.mu.Lock()
+	m.data[key] = foo
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemDatastore) Delete(key string) error {
+	m.mu.Lock()
+	delete(m.data, key)
+	m.mu.Unlock()
+	return nil
+}
+
+// Keys returns every key currently stored.  Handy in tests that
+// want to tamper with the (adversarial) storage.
+func (m *MemDatastore) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.data))
+	for k := range m.data {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
 func KeystoreClear() {
 	keystore = make(map[string]rsa.PublicKey)
+	keystoreMu.Lock()
+	keystoreLog = newKeyLog()
+	keystoreMu.Unlock()
 }
 
+// Overwrites the key for a name without any checks.  Use DefaultKeystore
+// (or another Keystore) to register keys outside of tests.
 func KeystoreSet(key string, value rsa.PublicKey) {
 	keystore[key] = value
 }
@@ -153,6 +263,32 @@ func RSAVerify(pub *rsa.PublicKey, msg []byte, sig []byte) error {
 	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], sig)
 }
 
+// Ed25519 key pair types, used where many cheap signing keys are
+// needed (RSA keys are slow to generate)
+type SignKey = ed25519.PrivateKey
+type VerifyKey = ed25519.PublicKey
+
+// Generates a fresh Ed25519 key pair
+func GenerateSignKey() (VerifyKey, SignKey, error) {
+	return ed25519.GenerateKey(rand.Reader)
+}
+
+// Ed25519 signature generation
+func Sign(priv SignKey, msg []byte) ([]byte, error) {
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, errors.New("bad signing key")
+	}
+	return ed25519.Sign(priv, msg), nil
+}
+
+// Ed25519 signature verification
+func Verify(pub VerifyKey, msg []byte, sig []byte) error {
+	if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, msg, sig) {
+		return errors.New("verification failure")
+	}
+	return nil
+}
+
 // HMAC
 func NewHMAC(key []byte) hash.Hash {
 	return hmac.New(sha256.New, key)
@@ -197,3 +333,36 @@ func CFBDecrypter(key []byte, iv []byte) cipher.Stream {
 	}
 	return cipher.NewCFBDecrypter(block, iv)
 }
+
+// Authenticated encryption with AES-GCM.  A random nonce is prepended
+// to the returned ciphertext; ad is authenticated but not encrypted
+// and must be passed again to AEADOpen.
+func AEADSeal(key []byte, plaintext []byte, ad []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	nonce := RandomBytes(NonceSize)
+	return gcm.Seal(nonce, nonce, plaintext, ad)
+}
+
+// Opens a ciphertext produced by AEADSeal.  Fails if the ciphertext,
+// the key or the associated data differ from what was sealed.
+func AEADOpen(key []byte, ciphertext []byte, ad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < NonceSize+gcm.Overhead() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, ciphertext[:NonceSize], ciphertext[NonceSize:], ad)
+}
@@ -33,6 +33,29 @@ func TestDatastore(t *testing.T) {
 
 }
 
+func TestMemDatastore(t *testing.T) {
+	var ds Datastore = NewMemDatastore()
+	value := []byte("bar")
+	ds.Set("foo", value)
+	value[0] = 'c'
+	data, valid := ds.Get("foo")
+	if !valid || string(data) != "bar" {
+		t.Error("Improper fetch", string(data))
+	}
+	data[0] = 'c'
+	data, _ = ds.Get("foo")
+	if string(data) != "bar" {
+		t.Error("Fetched value aliases the stored one")
+	}
+	if _, valid = DatastoreGet("foo"); valid {
+		t.Error("MemDatastore leaked into the global datastore")
+	}
+	ds.Delete("foo")
+	if _, valid = ds.Get("foo"); valid {
+		t.Error("Delete did not remove the key")
+	}
+}
+
 func TestRSA(t *testing.T) {
 	key, err := GenerateRSAKey()
 	if err != nil {
@@ -154,6 +177,55 @@ func TestStreamCipher(t *testing.T) {
 	}
 }
 
+func TestAEAD(t *testing.T) {
+	key := RandomBytes(AESKeySize)
+	msg := "This is a Test"
+	ciphertext := AEADSeal(key, []byte(msg), []byte("addr1"))
+	t.Log("Message  ", hex.EncodeToString(ciphertext))
+
+	plaintext, err := AEADOpen(key, ciphertext, []byte("addr1"))
+	if err != nil || string(plaintext) != msg {
+		t.Error("Decryption failure", err)
+	}
+	if _, err = AEADOpen(key, ciphertext, []byte("addr2")); err == nil {
+		t.Error("Opened with the wrong associated data")
+	}
+	if _, err = AEADOpen(RandomBytes(AESKeySize), ciphertext,
+		[]byte("addr1")); err == nil {
+		t.Error("Opened with the wrong key")
+	}
+	ciphertext[len(ciphertext)/2] ^= 1
+	if _, err = AEADOpen(key, ciphertext, []byte("addr1")); err == nil {
+		t.Error("Opened a tampered ciphertext")
+	}
+	if _, err = AEADOpen(key, ciphertext[:4], nil); err == nil {
+		t.Error("Opened a truncated ciphertext")
+	}
+}
+
+func TestSignKey(t *testing.T) {
+	pub, priv, err := GenerateSignKey()
+	if err != nil {
+		t.Fatal("Key generation failed", err)
+	}
+	sig, err := Sign(priv, []byte("write"))
+	if err != nil {
+		t.Fatal("Signing failed", err)
+	}
+	if err = Verify(pub, []byte("write"), sig); err != nil {
+		t.Error("Verification failed", err)
+	}
+	if err = Verify(pub, []byte("wrong"), sig); err == nil {
+		t.Error("Verified the wrong message")
+	}
+	if err = Verify(nil, []byte("write"), sig); err == nil {
+		t.Error("Verified with a missing key")
+	}
+	if _, err = Sign(nil, []byte("write")); err == nil {
+		t.Error("Signed with a missing key")
+	}
+}
+
 // Deliberate fail example
 // func TestFailure(t *testing.T){
 //	t.Log("This test will fail")